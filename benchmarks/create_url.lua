@@ -1,6 +1,9 @@
 -- Seed random number generator per thread
 math.randomseed(os.time())
 
+-- API key created with POST /keys
+local api_key = os.getenv("CHOPURL_API_KEY")
+
 request = function()
   local unique_suffix = os.time() .. "-" .. math.random(1000, 9999)
   local long_url = "http://very.long.url.example.com/path/to/resource?id=" .. unique_suffix
@@ -8,6 +11,9 @@ request = function()
   wrk.method = "POST"
   wrk.path = "/create"
   wrk.headers["Content-Type"] = "application/json"
+  if api_key then
+    wrk.headers["Authorization"] = "Bearer " .. api_key
+  end
   wrk.body = string.format('{"long_url": "%s"}', long_url)
   
   return wrk.format() -- This is important!
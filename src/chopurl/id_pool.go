@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/store"
+)
+
+// localReserveSize is the number of ids reserved per save of the pool state,
+// at most this many are lost per restart
+const localReserveSize = 1000
+
+var ErrIdPoolExhausted = errors.New("no ids left in the first generation")
+
+// idPoolStore is a link store that keeps the state of the id pool
+type idPoolStore interface {
+	store.LinkStore
+	MaxID() (int64, error)
+	GetIDPool() (*store.IDPoolState, error)
+	SaveIDPool(state *store.IDPoolState) error
+}
+
+// LocalIdPool replaces the id allocation service when a single process owns
+// the link store. A counter walks a keyed Feistel permutation of the first
+// generation ids past the ids stored before the pool, so the codes cannot be
+// guessed from each other. Like the offset of a segment, the counter is
+// reserved ahead in the store and a restart resumes from the reserved
+// offset without reusing an id.
+type LocalIdPool struct {
+	lock   sync.Mutex
+	store  idPoolStore
+	state  store.IDPoolState         // state saved in the store
+	offset int64                     // offset of the next id in the permutation
+	size   int64                     // number of ids of the permutation
+	ids    *codec.FeistelPermutation // permutation of the 0-based ids past the base
+	popped atomic.Int64              // ids handed out
+}
+
+// NewLocalIdPool resumes the pool saved in the store, or starts a pool with
+// a new seed past the largest ID of the store
+func NewLocalIdPool(idStore idPoolStore) (*LocalIdPool, error) {
+	state, err := idStore.GetIDPool()
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		maxID, err := idStore.MaxID()
+		if err != nil {
+			return nil, err
+		}
+		state = &store.IDPoolState{Seed: rand.Int63(), Base: maxID}
+		if err := idStore.SaveIDPool(state); err != nil {
+			return nil, err
+		}
+	}
+
+	// the ids of the first generation are [1, GenerationLimit(1))
+	size := codec.GenerationLimit(1) - 1 - state.Base
+	if size <= 0 {
+		return nil, ErrIdPoolExhausted
+	}
+
+	return &LocalIdPool{
+		store:  idStore,
+		state:  *state,
+		offset: state.Reserved,
+		size:   size,
+		ids:    codec.NewFeistelPermutation(int(size), state.Seed),
+	}, nil
+}
+
+// Pop hands out the next id
+func (p *LocalIdPool) Pop() (int64, error) {
+	ids, err := p.PopN(1)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// PopN hands out the next n ids
+func (p *LocalIdPool) PopN(n int) ([]int64, error) {
+	if n <= 0 {
+		return nil, errors.New("number of ids must be positive")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	end := p.offset + int64(n)
+	if end > p.size {
+		return nil, ErrIdPoolExhausted
+	}
+
+	// reserve the ids in the store before handing them out
+	if end > p.state.Reserved {
+		state := p.state
+		state.Reserved = min(end+localReserveSize, p.size)
+		if err := p.store.SaveIDPool(&state); err != nil {
+			return nil, err
+		}
+		p.state = state
+	}
+
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = p.state.Base + int64(p.ids.At(int(p.offset))) + 1
+		p.offset++
+	}
+	p.popped.Add(int64(n))
+
+	return ids, nil
+}
+
+// WriteMetrics writes the metrics of the pool in the Prometheus text format
+func (p *LocalIdPool) WriteMetrics(w io.Writer) {
+	p.lock.Lock()
+	offset := p.offset
+	p.lock.Unlock()
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value int64
+	}{
+		{"id_pool_popped_total", "counter", "Ids handed out.", p.popped.Load()},
+		{"id_pool_remaining", "gauge", "Ids of the first generation never handed out.", p.size - offset},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
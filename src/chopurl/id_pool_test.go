@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+)
+
+func TestLocalIdPoolResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chopurl.db")
+
+	// open the store again for every run of the pool, like a restart
+	run := func(n int) []int64 {
+		linkStore, cleanup, err := store.NewSQLiteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+
+		pool, err := NewLocalIdPool(linkStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := pool.PopN(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := pool.Pop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(ids, id)
+	}
+
+	seen := make(map[int64]bool)
+	sequential := 0
+	for _, n := range []int{10, localReserveSize + 5, 1} {
+		ids := run(n)
+		for i, id := range ids {
+			if id <= 0 || id >= codec.GenerationLimit(1) {
+				t.Fatalf("id %d outside the first generation", id)
+			}
+			if seen[id] {
+				t.Fatalf("id %d handed out twice", id)
+			}
+			seen[id] = true
+			if i > 0 && id == ids[i-1]+1 {
+				sequential++
+			}
+		}
+	}
+
+	if sequential > 0 {
+		t.Errorf("%d ids follow the previous one", sequential)
+	}
+}
+
+func TestLocalIdPoolSkipsStoredIDs(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	if err := linkStore.SaveURL(&model.URLEvent{ID: 500, LongURL: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := NewLocalIdPool(linkStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := pool.PopN(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if id <= 500 {
+			t.Fatalf("id %d handed out at or below the stored links", id)
+		}
+	}
+}
+
+func TestLocalIdPoolExhausted(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	// three ids of the first generation are left
+	if err := linkStore.SaveURL(&model.URLEvent{ID: codec.GenerationLimit(1) - 4, LongURL: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := NewLocalIdPool(linkStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.PopN(4); !errors.Is(err, ErrIdPoolExhausted) {
+		t.Fatalf("PopN(4) error = %v, want ErrIdPoolExhausted", err)
+	}
+	ids, err := pool.PopN(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("PopN(3) = %v, want the 3 remaining ids", ids)
+	}
+	if _, err := pool.Pop(); !errors.Is(err, ErrIdPoolExhausted) {
+		t.Errorf("Pop() error = %v, want ErrIdPoolExhausted", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Command chopurl runs the shorten API and the redirects in a single process
+// for development and small installs. The links are kept in SQLite or memory,
+// the IDs are allocated in process and the cache lives in memory, so it
+// starts without any external service. API keys, click stats and the outbox
+// need Cassandra, Kafka and Redis and are not available.
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/qninh/chopurl/url-redirect-service/redirect"
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/config"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/qninhdt/chopurl/src/url-shorten-service/shorten"
+	"github.com/valyala/fasthttp"
+
+	// database/sql drivers of the postgres and sqlite link stores
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+type MemoryCacheOptions struct {
+	Size int `mapstructure:"size"` // maximum number of cached codes, 0 disables the cache
+}
+
+func main() {
+	// load configuration
+	v, err := config.Load()
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
+
+	// bind to cache.Options, only the TTLs are used by the memory cache
+	cacheOptions, err := config.CacheOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Cache options: ", err)
+	}
+
+	// bind to store.Options, the links are kept in SQLite by default
+	storeOptions, err := config.StoreOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Store options: ", err)
+	}
+
+	if !v.IsSet("store.backend") {
+		storeOptions.Backend = "sqlite"
+	}
+
+	// bind to MemoryCacheOptions
+	var memoryCacheOptions MemoryCacheOptions
+	if err := v.UnmarshalKey("memory_cache", &memoryCacheOptions); err != nil {
+		log.Fatal("Error unmarshalling Memory Cache options: ", err)
+	}
+
+	if !v.IsSet("memory_cache.size") {
+		memoryCacheOptions.Size = 100000
+	}
+
+	// bind to ServerOptions
+	var serverOptions shorten.ServerOptions
+	if err := v.UnmarshalKey("server", &serverOptions); err != nil {
+		log.Fatal("Error unmarshalling Server options: ", err)
+	}
+
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		serverOptions.Port = envPort
+	}
+	if serverOptions.Port == "" {
+		serverOptions.Port = "8080"
+	}
+	if serverOptions.ShutdownTimeout <= 0 {
+		serverOptions.ShutdownTimeout = 10 * time.Second
+	}
+	if serverOptions.MaxBatchSize <= 0 {
+		serverOptions.MaxBatchSize = 50000
+	}
+	if serverOptions.MaxRequestBodySize <= 0 {
+		serverOptions.MaxRequestBodySize = 16 * 1024 * 1024
+	}
+
+	// the X-Real-IP header is only trusted from these proxies
+	trustedProxies, err := shorten.NewTrustedProxies(serverOptions.TrustedProxies)
+	if err != nil {
+		log.Fatal("Error in Server options: ", err)
+	}
+
+	// bind to RateLimitOptions, a max_rps of 0 disables rate limiting
+	var rateLimitOptions shorten.RateLimitOptions
+	if err := v.UnmarshalKey("server", &rateLimitOptions); err != nil {
+		log.Fatal("Error unmarshalling Rate Limit options: ", err)
+	}
+
+	if rateLimitOptions.MaxRPS <= 0 {
+		rateLimitOptions.DisableRateLimit = true
+	}
+	if rateLimitOptions.Burst <= 0 {
+		rateLimitOptions.Burst = int(math.Ceil(rateLimitOptions.MaxRPS))
+	}
+	if rateLimitOptions.Shared {
+		log.Fatal("Error in Rate Limit options: shared_rate_limit requires Redis")
+	}
+
+	// bind to DomainOptions, the redirects of the custom domains are served
+	// by this process as well
+	var domainOptions shorten.DomainOptions
+	if err := v.UnmarshalKey("domains", &domainOptions); err != nil {
+		log.Fatal("Error unmarshalling Domain options: ", err)
+	}
+
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		domainOptions.BaseURL = baseURL
+	}
+	if domainOptions.BaseURL == "" {
+		domainOptions.BaseURL = "http://localhost:" + serverOptions.Port + "/short/"
+	}
+
+	domains, err := shorten.NewDomains(&domainOptions)
+	if err != nil {
+		log.Fatal("Error in Domain options: ", err)
+	}
+
+	var redirectDomainOptions redirect.DomainOptions
+	for _, custom := range domainOptions.Custom {
+		redirectDomainOptions.Hosts = append(redirectDomainOptions.Hosts, custom.Host)
+	}
+
+	// init link store, there is no Cassandra in this mode
+	linkStore, cleanup, err := store.New(storeOptions, nil)
+	if err != nil {
+		log.Fatal("Error initializing Link Store: ", err)
+	}
+	defer cleanup()
+
+	// init id pool, its state is kept in the store with the links
+	idStore, ok := linkStore.(idPoolStore)
+	if !ok {
+		log.Fatal("Error initializing ID Pool: the " + storeOptions.Backend + " backend cannot be used by a single process")
+	}
+	idPool, err := NewLocalIdPool(idStore)
+	if err != nil {
+		log.Fatal("Error initializing ID Pool: ", err)
+	}
+
+	// init memory cache, both APIs share it so updates are seen at once
+	memoryCache := cache.NewMemoryCache(memoryCacheOptions.Size)
+	if memoryCacheOptions.Size <= 0 {
+		log.Println("Memory cache is disabled")
+	}
+
+	// init rate limiter, redirects are not rate limited
+	var rateLimiter shorten.RateLimiter
+	if rateLimitOptions.DisableRateLimit {
+		log.Println("Rate limiting is disabled")
+	} else {
+		localRateLimiter, cleanup := shorten.NewLocalRateLimiter(&rateLimitOptions)
+		defer cleanup()
+		rateLimiter = localRateLimiter
+	}
+
+	// the API keys are kept in Cassandra, every request is anonymous
+	authOptions := shorten.AuthOptions{}
+	authenticator := shorten.NewAuthenticator(&authOptions, nil)
+
+	// the routes of the shorten API, a failed store write fails the request
+	// as there is no outbox
+	shortenHandler := shorten.NewHandler(&shorten.Dependencies{
+		Cache:          memoryCache,
+		CacheOptions:   cacheOptions,
+		IdPool:         idPool,
+		LinkStore:      linkStore,
+		Authenticator:  authenticator,
+		AuthOptions:    &authOptions,
+		RateLimiter:    rateLimiter,
+		TrustedProxies: trustedProxies,
+		Domains:        domains,
+		ServerOptions:  &serverOptions,
+	})
+
+	// the redirects, clicks are not recorded without Kafka
+	redirectHandler := redirect.NewHandler(&redirect.Dependencies{
+		Resolver:     redirect.NewResolver(nil, memoryCache, linkStore, nil, cacheOptions),
+		Domains:      redirect.NewDomains(&redirectDomainOptions),
+		ClickOptions: &redirect.ClickOptions{},
+	})
+
+	// Set up the handler, /short/ is routed to the redirect service by nginx
+	router := func(ctx *fasthttp.RequestCtx) {
+		if strings.HasPrefix(string(ctx.Path()), "/short/") {
+			redirectHandler(ctx)
+			return
+		}
+		shortenHandler(ctx)
+	}
+
+	server := &fasthttp.Server{
+		Handler:            router,
+		MaxRequestBodySize: serverOptions.MaxRequestBodySize,
+	}
+
+	go func() {
+		log.Println("Starting server on port", serverOptions.Port)
+		if err := server.ListenAndServe(":" + serverOptions.Port); err != nil {
+			log.Fatal("Error starting server: ", err)
+		}
+	}()
+
+	// wait for a termination signal
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	// stop accepting connections and drain in-flight requests before the
+	// deferred cleanups close the store
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverOptions.ShutdownTimeout)
+	defer cancel()
+	if err := server.ShutdownWithContext(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+)
+
+var (
+	ErrSegmentNotOwned   = errors.New("segment is no longer owned by this instance")
+	ErrSegmentsExhausted = errors.New("all numbers have been generated")
+	ErrSegmentConflict   = errors.New("segment allocation lost to a concurrent allocation")
+	ErrIdsUnavailable    = errors.New("no ids available")
+)
+
+// IdSource hands out segments of the id space and records the state of the
+// segments held by an allocator. A held segment is owned by one instance,
+// when the instance dies without returning it the source lets another
+// instance reclaim it from its last recorded offset.
+type IdSource interface {
+	// AllocateSegment claims a segment never handed out before and records
+	// its initial state, it fails with ErrSegmentConflict when a concurrent
+	// allocation won and may simply be retried
+	AllocateSegment(state segmentState) (int, error)
+	// ReclaimSegment claims a partially used segment left without an owner,
+	// it returns a zero segment ID when there is none
+	ReclaimSegment() (int, *segmentState, error)
+	// UpdateSegment records the state of an owned segment, it fails with
+	// ErrSegmentNotOwned when the segment was lost to another instance
+	UpdateSegment(segmentId int, state segmentState) error
+	// ReturnSegment records the state of an owned segment and gives up its
+	// ownership so another instance can reclaim it
+	ReturnSegment(segmentId int, state segmentState) error
+	// ReleaseSegment forgets an exhausted segment
+	ReleaseSegment(segmentId int) error
+	// RemainingSegments returns the number of segments never allocated
+	RemainingSegments() (int, error)
+	// Available reports whether the held segments are still owned, no id
+	// is handed out while the ownership is being recovered
+	Available() bool
+}
+
+// IdAllocator hands out IDs from segments claimed from an IdSource. The IDs
+// of a segment are handed out in the order of a permutation seeded by the
+// segment seed, so the remaining IDs can be rebuilt from the seed and an
+// offset.
+//
+// The source records a reserved offset of every held segment and IDs are
+// only handed out below it, so when an instance dies any instance can
+// reclaim its segments from the reserved offset without reusing an ID.
+type IdAllocator struct {
+	segment     *segment  // segment ids are allocated from
+	nextSegment *segment  // pre-requested segment from the source
+	requesting  bool      // whether the next segment is being requested
+	retryAt     time.Time // when a failed request of the next segment may be retried
+	released    bool      // whether the segments were handed back to the source
+	lock        sync.Mutex
+	ready       *sync.Cond // signaled when a request of the next segment completes
+	source      IdSource
+	base        int64        // first id of the generation
+	warned      atomic.Int64 // number of exhaustion warnings already logged
+	metrics     idAllocatorMetrics
+	options     *IdAllocatorOptions
+}
+
+// idAllocatorMetrics counts the segment requests, the ratio of conflicts to
+// attempts is the contention on the source
+type idAllocatorMetrics struct {
+	attempts    atomic.Int64 // segment request attempts
+	conflicts   atomic.Int64 // attempts lost to a concurrent allocation
+	failures    atomic.Int64 // segment requests failed after all retries
+	unavailable atomic.Int64 // Pop calls failed without an id
+	remaining   atomic.Int64 // segments of the generation never allocated
+}
+
+// segment is a segment owned by this instance
+type segment struct {
+	id       int         // segment id, 1-based
+	seed     int64       // seed of the permutation of the ids
+	mode     string      // permutation mode, fixed for the life of the segment
+	offset   int         // number of ids handed out
+	reserved int         // offset recorded in the source, ids are only handed out below it
+	lost     bool        // whether a peer reclaimed the segment, it is neither released nor returned
+	ids      permutation // permutation of the 0-based ids of the segment
+}
+
+// segmentState is recorded by the source for every held segment
+type segmentState struct {
+	Seed   int64  `json:"seed"`
+	Mode   string `json:"mode,omitempty"` // empty for segments held before the mode was recorded
+	Offset int    `json:"offset"`
+}
+
+type IdAllocatorOptions struct {
+	SegmentSize     int           `mapstructure:"segment_size"`      // size of the segment
+	QueueThreshold  float32       `mapstructure:"queue_threshold"`   // threshold for pre-requesting a new segment
+	SegmentCountKey string        `mapstructure:"segment_count_key"` // key for the segment count in etcd or redis
+	SegmentMapKey   string        `mapstructure:"segment_map_key"`   // key for the segment map in etcd or redis
+	SegmentAllocKey string        `mapstructure:"segment_alloc_key"` // key prefix recording allocated segments in etcd, read by the redirect service
+	SegmentStateKey string        `mapstructure:"segment_state_key"` // key of the seed and reserved offset of held segments
+	SegmentOwnerKey string        `mapstructure:"segment_owner_key"` // key prefix of the owners of held segments
+	MaxSegmentCount int           `mapstructure:"max_segment_count"` // maximum number of segments
+	ReserveSize     int           `mapstructure:"reserve_size"`      // ids reserved per offset update, at most this many are lost per crash
+	LeaseTTL        time.Duration `mapstructure:"lease_ttl"`         // ttl of the ownership of an instance, segments of a dead instance are reclaimed after it
+	Permutation     string        `mapstructure:"permutation"`       // order of the ids of new segments, "shuffle" or "feistel"
+	Source          string        `mapstructure:"source"`            // source of the segments, "etcd", "redis" or "memory"
+	RetryAttempts   int           `mapstructure:"retry_attempts"`    // maximum attempts of a segment request
+	RetryBaseDelay  time.Duration `mapstructure:"retry_base_delay"`  // backoff before the first retry, doubled on every retry
+	RetryMaxDelay   time.Duration `mapstructure:"retry_max_delay"`   // maximum backoff between retries
+	RetryTimeout    time.Duration `mapstructure:"retry_timeout"`     // deadline of a segment request including its retries
+	Generation      int           `mapstructure:"generation"`        // generation of the ids, generation g > 1 produces codes of 6+g characters
+	ExhaustionWarn  []float64     `mapstructure:"exhaustion_warn"`   // ratios of remaining segments logging a warning when crossed
+}
+
+// maxGeneration is the last generation whose ids fit in an int64
+const maxGeneration = 4
+
+// GenerationBase returns the first id of a generation. The first generation
+// fills the 7 character codes from 1, generation g > 1 fills the codes of
+// 6+g characters, so the codes of a generation never decode to the ids of
+// another.
+func GenerationBase(generation int) int64 {
+	if generation <= 1 {
+		return 0
+	}
+	return codec.GenerationLimit(generation - 1)
+}
+
+// ApplyGeneration checks that the segments fit in the generation and moves
+// the keys of a later generation to their own namespace, the segments of
+// each generation are allocated independently
+func (o *IdAllocatorOptions) ApplyGeneration() error {
+	if o.Generation < 1 || o.Generation > maxGeneration {
+		return fmt.Errorf("generation must be between 1 and %d", maxGeneration)
+	}
+
+	if int64(o.MaxSegmentCount)*int64(o.SegmentSize) >= codec.GenerationLimit(o.Generation)-GenerationBase(o.Generation) {
+		return fmt.Errorf("max_segment_count * segment_size exceeds the ids of generation %d", o.Generation)
+	}
+
+	if o.Generation > 1 {
+		suffix := fmt.Sprintf("_g%d", o.Generation)
+		o.SegmentCountKey += suffix
+		o.SegmentMapKey += suffix
+		o.SegmentAllocKey += suffix
+		o.SegmentStateKey += suffix
+		o.SegmentOwnerKey += suffix
+	}
+
+	return nil
+}
+
+// ApplyKeyPrefix moves the keys to the keyspace of a namespace, the segments
+// of each namespace are allocated independently
+func (o *IdAllocatorOptions) ApplyKeyPrefix(prefix string) {
+	o.SegmentCountKey = prefix + o.SegmentCountKey
+	o.SegmentMapKey = prefix + o.SegmentMapKey
+	o.SegmentAllocKey = prefix + o.SegmentAllocKey
+	o.SegmentStateKey = prefix + o.SegmentStateKey
+	o.SegmentOwnerKey = prefix + o.SegmentOwnerKey
+}
+
+func NewIdAllocator(options *IdAllocatorOptions, source IdSource) (*IdAllocator, func(), error) {
+	idAllocator := &IdAllocator{
+		source:  source,
+		base:    GenerationBase(options.Generation),
+		options: options,
+	}
+	idAllocator.ready = sync.NewCond(&idAllocator.lock)
+
+	// request the initial segment, a segment left by a dead instance is
+	// reclaimed before a new one is allocated
+	var err error
+	idAllocator.segment, err = idAllocator.requestSegment()
+	if err != nil {
+		return nil, nil, errors.New("failed to allocate initial segment: " + err.Error())
+	}
+
+	log.Printf("Allocated initial segment with ID: %d, generation %d", idAllocator.segment.id, options.Generation)
+	idAllocator.checkRemaining()
+
+	return idAllocator, idAllocator.release, nil
+}
+
+// Pop hands out the next id. It fails with ErrIdsUnavailable when no segment
+// can be used right now, the caller may retry later.
+func (ia *IdAllocator) Pop() (int64, error) {
+	ids, err := ia.PopN(1)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// PopN hands out n ids under a single lock acquisition, crossing into the
+// next segment when the current one runs out. On error the ids handed out
+// so far are returned with it, they are not handed out again.
+func (ia *IdAllocator) PopN(n int) ([]int64, error) {
+	if n <= 0 {
+		return nil, errors.New("number of ids must be positive")
+	}
+
+	// lock the queue to prevent concurrent access
+	ia.lock.Lock()
+	defer ia.lock.Unlock()
+
+	ids := make([]int64, 0, n)
+	for len(ids) < n {
+		id, err := ia.next(n - len(ids))
+		if err != nil {
+			ia.metrics.unavailable.Add(1)
+			if errors.Is(err, ErrSegmentsExhausted) {
+				return ids, err
+			}
+			return ids, fmt.Errorf("%w: %v", ErrIdsUnavailable, err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// next hands out the next id, wanted is the number of ids the caller still
+// needs. The lock must be held.
+func (ia *IdAllocator) next(wanted int) (int64, error) {
+	if ia.released {
+		return 0, errors.New("id allocator is shut down")
+	}
+	if !ia.source.Available() {
+		return 0, errors.New("segment ownership is being recovered")
+	}
+
+	ia.prefetch()
+
+	// check if we need to switch the segment
+	if ia.segment.offset == ia.options.SegmentSize {
+		if err := ia.switchSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	// reserve the next ids in the source before handing them out
+	if ia.segment.offset == ia.segment.reserved {
+		if err := ia.reserve(ia.segment, wanted); err != nil {
+			if !errors.Is(err, ErrSegmentNotOwned) {
+				return 0, err
+			}
+
+			// a peer reclaimed the segment from its reserved offset while
+			// the ownership was lost, the ids left are its own now
+			log.Printf("Lost segment %d at offset %d to a peer", ia.segment.id, ia.segment.offset)
+			ia.segment.lost = true
+			ia.segment.offset = ia.options.SegmentSize
+			return ia.next(wanted)
+		}
+	}
+
+	localId := ia.segment.ids.At(ia.segment.offset)
+	ia.segment.offset++
+
+	// convert to global 64-bit ID
+	// minus 1 to convert from 1-based to 0-based segment id
+	// the base moves the ids of later generations past the shorter codes
+	globalId := ia.base + int64(ia.segment.id-1)*int64(ia.options.SegmentSize) + int64(localId) + 1
+
+	return globalId, nil
+}
+
+// prefetch requests the next segment in the background once the current one
+// falls below the threshold. The lock must be held.
+func (ia *IdAllocator) prefetch() {
+	threshold := int(ia.options.QueueThreshold * float32(ia.options.SegmentSize))
+	if ia.options.SegmentSize-ia.segment.offset > threshold || ia.nextSegment != nil || ia.requesting ||
+		time.Now().Before(ia.retryAt) {
+		return
+	}
+
+	ia.requesting = true
+
+	// request a new segment in the background to avoid blocking
+	job := func() {
+		next, err := ia.requestSegment()
+		ia.checkRemaining()
+
+		ia.lock.Lock()
+		defer ia.lock.Unlock()
+
+		// wake up the callers waiting for the next segment
+		defer ia.ready.Broadcast()
+
+		ia.requesting = false
+		if ia.released {
+			// next is reclaimed by a peer once the source is closed
+			return
+		}
+		if err != nil {
+			// Pop fails once the current segment runs out, the request
+			// is retried after a pause
+			log.Println("failed to request new segment:", err)
+			ia.retryAt = time.Now().Add(ia.options.RetryMaxDelay)
+			return
+		}
+
+		ia.nextSegment = next
+
+		log.Println("Requested new segment with ID:", next.id)
+	}
+	go job()
+}
+
+// switchSegment moves to the next segment once the current one is exhausted.
+// It waits for a request of the next segment in flight, the lock is released
+// while waiting so another caller may switch first.
+func (ia *IdAllocator) switchSegment() error {
+	for ia.nextSegment == nil && ia.requesting && !ia.released {
+		ia.ready.Wait()
+	}
+
+	if ia.released {
+		return errors.New("id allocator is shut down")
+	}
+	if ia.segment.offset < ia.options.SegmentSize {
+		return nil
+	}
+	if ia.nextSegment == nil {
+		return errors.New("no next segment ID available")
+	}
+
+	// the exhausted segment is no longer needed for recovery, a lost one
+	// belongs to a peer
+	if !ia.segment.lost {
+		if err := ia.source.ReleaseSegment(ia.segment.id); err != nil {
+			log.Printf("Error releasing segment %d: %v", ia.segment.id, err)
+		}
+	}
+
+	ia.segment = ia.nextSegment
+	ia.nextSegment = nil
+
+	log.Println("Switched to new segment with ID:", ia.segment.id)
+
+	return nil
+}
+
+// reserve records a higher reserved offset of seg in the source, covering at
+// least the wanted ids. It fails when the segment is no longer owned by this
+// instance.
+func (ia *IdAllocator) reserve(seg *segment, wanted int) error {
+	reserved := min(seg.offset+max(ia.options.ReserveSize, wanted), ia.options.SegmentSize)
+	if err := ia.source.UpdateSegment(seg.id, segmentState{Seed: seg.seed, Mode: seg.mode, Offset: reserved}); err != nil {
+		return err
+	}
+
+	seg.reserved = reserved
+	return nil
+}
+
+// release hands the unused ids of the held segments back to the source. The
+// exact offsets are recorded and the ownership given up, so peers reclaim
+// the segments where this instance stopped.
+func (ia *IdAllocator) release() {
+	ia.lock.Lock()
+	defer ia.lock.Unlock()
+
+	if ia.released {
+		return
+	}
+	ia.released = true
+	ia.ready.Broadcast()
+
+	for _, seg := range []*segment{ia.segment, ia.nextSegment} {
+		if seg == nil || seg.lost {
+			continue
+		}
+
+		// an exhausted segment has nothing left to return
+		var err error
+		if seg.offset == ia.options.SegmentSize {
+			err = ia.source.ReleaseSegment(seg.id)
+		} else {
+			err = ia.source.ReturnSegment(seg.id, segmentState{Seed: seg.seed, Mode: seg.mode, Offset: seg.offset})
+		}
+		if err != nil {
+			// the segment is still reclaimed from its reserved offset
+			log.Printf("Error returning segment %d: %v", seg.id, err)
+			continue
+		}
+
+		log.Printf("Returned segment %d at offset %d", seg.id, seg.offset)
+	}
+}
+
+// requestSegment requests a segment from the source, retrying failed
+// attempts with a jittered exponential backoff until the attempts or the
+// deadline run out
+func (ia *IdAllocator) requestSegment() (*segment, error) {
+	deadline := time.Now().Add(ia.options.RetryTimeout)
+	delay := ia.options.RetryBaseDelay
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var seg *segment
+		ia.metrics.attempts.Add(1)
+		seg, err = ia.trySegment()
+		if err == nil {
+			return seg, nil
+		}
+
+		if errors.Is(err, ErrSegmentConflict) {
+			ia.metrics.conflicts.Add(1)
+		}
+		if errors.Is(err, ErrSegmentsExhausted) || attempt >= ia.options.RetryAttempts {
+			break
+		}
+
+		// full jitter spreads out instances that lost the same race
+		backoff := time.Duration(rand.Int63n(int64(delay))) + 1
+		if time.Now().Add(backoff).After(deadline) {
+			break
+		}
+		time.Sleep(backoff)
+		delay = min(delay*2, ia.options.RetryMaxDelay)
+	}
+
+	ia.metrics.failures.Add(1)
+	return nil, fmt.Errorf("failed to request segment: %w", err)
+}
+
+// trySegment reclaims a segment left by a dead instance, or allocates a new
+// one when there is none
+func (ia *IdAllocator) trySegment() (*segment, error) {
+	segmentId, state, err := ia.source.ReclaimSegment()
+	if err != nil {
+		return nil, err
+	}
+	if segmentId != 0 {
+		log.Printf("Reclaimed segment %d at offset %d", segmentId, state.Offset)
+		return ia.newSegment(segmentId, state.Seed, state.Mode, state.Offset), nil
+	}
+
+	seed := rand.Int63()
+	segmentId, err = ia.source.AllocateSegment(segmentState{Seed: seed, Mode: ia.options.Permutation})
+	if err != nil {
+		return nil, err
+	}
+
+	return ia.newSegment(segmentId, seed, ia.options.Permutation, 0), nil
+}
+
+// checkRemaining refreshes the number of remaining segments and logs a
+// warning when it crosses one of the exhaustion thresholds
+func (ia *IdAllocator) checkRemaining() {
+	remaining, err := ia.source.RemainingSegments()
+	if err != nil {
+		log.Println("failed to get remaining segment count:", err)
+		return
+	}
+	ia.metrics.remaining.Store(int64(remaining))
+
+	ratio := float64(remaining) / float64(ia.options.MaxSegmentCount)
+	crossed := 0
+	for _, threshold := range ia.options.ExhaustionWarn {
+		if ratio <= threshold {
+			crossed++
+		}
+	}
+
+	if int64(crossed) > ia.warned.Swap(int64(crossed)) {
+		log.Printf("WARNING: %d segments (%.2f%%) of generation %d remain, plan the migration to generation %d",
+			remaining, ratio*100, ia.options.Generation, ia.options.Generation+1)
+	}
+}
+
+// IdAllocatorStats is a snapshot of the state of an allocator
+type IdAllocatorStats struct {
+	Generation        int   // generation of the ids
+	GenerationBase    int64 // first id of the generation
+	SegmentSize       int   // ids per segment
+	SegmentsRemaining int64 // segments of the generation never allocated
+	SegmentsMax       int64 // segments of the generation
+	SegmentRemaining  int64 // ids left in the current segment
+	NextSegmentReady  bool  // whether the next segment has been requested
+	Attempts          int64 // segment request attempts
+	Conflicts         int64 // attempts lost to a concurrent allocation
+	Failures          int64 // segment requests failed after all retries
+	Unavailable       int64 // Pop calls failed without an id
+}
+
+// Stats returns a snapshot of the state of the allocator
+func (ia *IdAllocator) Stats() IdAllocatorStats {
+	ia.lock.Lock()
+	remaining := ia.options.SegmentSize - ia.segment.offset
+	nextReady := ia.nextSegment != nil
+	ia.lock.Unlock()
+
+	return IdAllocatorStats{
+		Generation:        ia.options.Generation,
+		GenerationBase:    ia.base,
+		SegmentSize:       ia.options.SegmentSize,
+		SegmentsRemaining: ia.metrics.remaining.Load(),
+		SegmentsMax:       int64(ia.options.MaxSegmentCount),
+		SegmentRemaining:  int64(remaining),
+		NextSegmentReady:  nextReady,
+		Attempts:          ia.metrics.attempts.Load(),
+		Conflicts:         ia.metrics.conflicts.Load(),
+		Failures:          ia.metrics.failures.Load(),
+		Unavailable:       ia.metrics.unavailable.Load(),
+	}
+}
+
+// newSegment rebuilds the permutation of a segment, a reclaimed segment keeps
+// the mode it was allocated with so the ids are walked in the same order
+func (ia *IdAllocator) newSegment(segmentId int, seed int64, mode string, offset int) *segment {
+	seg := &segment{
+		id:       segmentId,
+		seed:     seed,
+		mode:     mode,
+		offset:   offset,
+		reserved: offset,
+	}
+
+	if mode == PermutationFeistel {
+		seg.ids = codec.NewFeistelPermutation(ia.options.SegmentSize, seed)
+	} else {
+		seg.ids = NewShufflePermutation(ia.options.SegmentSize, seed)
+	}
+
+	return seg
+}
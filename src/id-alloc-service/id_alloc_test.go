@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pausableIdSource is a memory source whose ownership can be lost, like an
+// etcd source while its lease is re-acquired
+type pausableIdSource struct {
+	*MemoryIdSource
+	paused atomic.Bool
+}
+
+func (s *pausableIdSource) Available() bool {
+	return !s.paused.Load()
+}
+
+func testIdAllocatorOptions() *IdAllocatorOptions {
+	return &IdAllocatorOptions{
+		SegmentSize:     1000,
+		QueueThreshold:  0.2,
+		MaxSegmentCount: 10,
+		ReserveSize:     100,
+		Permutation:     PermutationFeistel,
+		RetryAttempts:   3,
+		RetryBaseDelay:  time.Millisecond,
+		RetryMaxDelay:   10 * time.Millisecond,
+		RetryTimeout:    time.Second,
+		Generation:      1,
+	}
+}
+
+func TestIdAllocatorUnavailable(t *testing.T) {
+	options := testIdAllocatorOptions()
+	source := &pausableIdSource{MemoryIdSource: NewMemoryIdSource(options)}
+	allocator, cleanup, err := NewIdAllocator(options, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if _, err := allocator.Pop(); err != nil {
+		t.Fatal(err)
+	}
+
+	source.paused.Store(true)
+	if _, err := allocator.Pop(); !errors.Is(err, ErrIdsUnavailable) {
+		t.Fatalf("Pop() while the ownership is lost error = %v, want ErrIdsUnavailable", err)
+	}
+
+	source.paused.Store(false)
+	if _, err := allocator.Pop(); err != nil {
+		t.Errorf("Pop() once the ownership is recovered error = %v", err)
+	}
+}
+
+// TestIdAllocatorLostSegment checks that a segment reclaimed by a peer is
+// dropped, the allocator moves on to another segment without handing out
+// an id twice
+func TestIdAllocatorLostSegment(t *testing.T) {
+	options := testIdAllocatorOptions()
+	source := NewMemoryIdSource(options)
+	allocator, cleanup, err := NewIdAllocator(options, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	seen := make(map[int64]bool)
+	pop := func(n int) {
+		ids, err := allocator.PopN(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("id %d handed out twice", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	// the first 100 ids are reserved, the segment is lost at its reserved
+	// offset and reclaimed from there
+	pop(50)
+	lost := allocator.segment
+	if err := source.ReturnSegment(lost.id, segmentState{Seed: lost.seed, Mode: lost.mode, Offset: lost.reserved}); err != nil {
+		t.Fatal(err)
+	}
+
+	pop(200)
+	if allocator.segment == lost || !lost.lost {
+		t.Error("lost segment still used")
+	}
+}
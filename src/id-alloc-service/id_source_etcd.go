@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// errLeaseLost fails the requests of the source while its lease is being
+// re-acquired
+var errLeaseLost = errors.New("etcd lease of the id allocator is lost")
+
+// EtcdIdSource allocates segments with a Fisher-Yates shuffle over etcd keys.
+// Held segments have an owner key attached to the etcd lease of the
+// instance, the segments of a dead instance are reclaimable once its lease
+// expires. When the lease of a live instance is lost, the source is
+// unavailable until a new lease is granted and the held segments that no
+// peer reclaimed in the meantime are moved to it.
+type EtcdIdSource struct {
+	etcdClient  *clientv3.Client
+	ownerName   string // value of the owner keys, for debugging
+	lock        sync.Mutex
+	leaseID     clientv3.LeaseID // lease of the owner keys of this instance
+	available   atomic.Bool      // false while the lease is being re-acquired
+	held        map[int]int64    // mod revision of the state of the held segments
+	options     *IdAllocatorOptions
+	etcdOptions *EtcdOptions
+}
+
+type EtcdOptions struct {
+	Address        string        `mapstructure:"address"`         // etcd address
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout"` // timeout in seconds
+	RequestTimeout time.Duration `mapstructure:"request_timeout"` // timeout in seconds
+}
+
+func NewEtcdIdSource(idAllocOptions *IdAllocatorOptions, etcdOptions *EtcdOptions) (*EtcdIdSource, func(), error) {
+	// create a new etcd client
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdOptions.Address},
+		DialTimeout: etcdOptions.ConnectTimeout,
+	})
+
+	if err != nil {
+		return nil, nil, errors.New("failed to connect to etcd: " + err.Error())
+	}
+
+	log.Println("Connected to etcd at", etcdOptions.Address)
+
+	// init ectd segment count if not exists
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOptions.ConnectTimeout)
+	defer cancel()
+
+	// Check if the segment count key already exists
+	resp, err := etcdClient.Get(ctx, idAllocOptions.SegmentCountKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get segment count key: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		// If it doesn't exist, initialize it with the maximum segment count
+		_, err = etcdClient.Put(ctx, idAllocOptions.SegmentCountKey, strconv.Itoa(idAllocOptions.MaxSegmentCount))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to initialize segment count key: %v", err)
+		}
+		log.Println("Initialized segment count key with value:", idAllocOptions.MaxSegmentCount)
+	}
+
+	// grant the lease of the owner keys and keep it alive
+	lease, err := etcdClient.Grant(ctx, int64(idAllocOptions.LeaseTTL.Seconds()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to grant lease: %v", err)
+	}
+
+	keepAliveCtx, stopKeepAlive := context.WithCancel(context.Background())
+	keepAlive, err := etcdClient.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		stopKeepAlive()
+		return nil, nil, fmt.Errorf("failed to keep lease alive: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	source := &EtcdIdSource{
+		etcdClient:  etcdClient,
+		ownerName:   fmt.Sprintf("%s/%x", hostname, lease.ID),
+		leaseID:     lease.ID,
+		held:        make(map[int]int64),
+		options:     idAllocOptions,
+		etcdOptions: etcdOptions,
+	}
+
+	source.available.Store(true)
+	go source.keepAlive(keepAliveCtx, keepAlive)
+
+	return source, func() {
+		stopKeepAlive()
+
+		// revoke the lease so peers can reclaim our segments right away
+		ctx, cancel := context.WithTimeout(context.Background(), etcdOptions.RequestTimeout)
+		defer cancel()
+		if _, err := etcdClient.Revoke(ctx, source.lease()); err != nil {
+			log.Println("failed to revoke etcd lease:", err)
+		}
+
+		if err := etcdClient.Close(); err != nil {
+			log.Println("failed to close etcd client:", err)
+		}
+	}, nil
+}
+
+// `AllocateSegment` requests a random segment ID from etcd using Fisher-Yates
+// shuffle algorithm. It atomically updates the segment count and remap
+// the selected index to the last position in the segment.
+func (s *EtcdIdSource) AllocateSegment(state segmentState) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.available.Load() {
+		return 0, errLeaseLost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.etcdOptions.RequestTimeout)
+	defer cancel()
+
+	// Get the current remaining count
+	resp, err := s.etcdClient.Get(ctx, s.options.SegmentCountKey)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remaining count: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, fmt.Errorf("remaining count not found, generator not initialized")
+	}
+
+	segmentCount, err := strconv.Atoi(string(resp.Kvs[0].Value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid remaining count: %v", err)
+	}
+
+	if segmentCount <= 0 {
+		return 0, ErrSegmentsExhausted
+	}
+
+	// Choose a random index from the remaining set
+	randomIndex := rand.Intn(segmentCount) + 1
+
+	// Check if this position has been remapped
+	remapKey := fmt.Sprintf("%s/%d", s.options.SegmentMapKey, randomIndex)
+	remapResp, err := s.etcdClient.Get(ctx, remapKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check remap: %v", err)
+	}
+
+	// Determine our result value
+	var result int
+	if len(remapResp.Kvs) > 0 {
+		result, err = strconv.Atoi(string(remapResp.Kvs[0].Value))
+		if err != nil {
+			return 0, fmt.Errorf("invalid remap value: %v", err)
+		}
+	} else {
+		result = randomIndex
+	}
+
+	// Get the value for the last position (if it exists)
+	lastPosKey := fmt.Sprintf("%s/%d", s.options.SegmentMapKey, segmentCount)
+	lastPosResp, err := s.etcdClient.Get(ctx, lastPosKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last position: %v", err)
+	}
+
+	// Build the transaction for atomically updating all values
+	txn := s.etcdClient.Txn(ctx)
+
+	// Make sure remaining count hasn't changed (optimistic concurrency control)
+	txn = txn.If(clientv3.Compare(clientv3.Value(s.options.SegmentCountKey), "=", string(resp.Kvs[0].Value)))
+
+	// Operations to perform if the check succeeds
+	var thenOps []clientv3.Op
+
+	// Update remaining count
+	thenOps = append(thenOps, clientv3.OpPut(s.options.SegmentCountKey, strconv.Itoa(segmentCount-1)))
+
+	// Update the remap for the randomly selected index
+	if len(lastPosResp.Kvs) > 0 {
+		// The last position was remapped, use that value
+		thenOps = append(thenOps, clientv3.OpPut(remapKey, string(lastPosResp.Kvs[0].Value)))
+	} else {
+		// Use the last position itself
+		thenOps = append(thenOps, clientv3.OpPut(remapKey, strconv.Itoa(segmentCount)))
+	}
+
+	// Record the allocated segment, the redirect service watches this prefix
+	// to reject codes from segments that were never handed out
+	thenOps = append(thenOps, clientv3.OpPut(fmt.Sprintf("%s/%d", s.options.SegmentAllocKey, result), ""))
+
+	// Hold the segment with its state, it is reclaimed if this instance dies
+	value, err := json.Marshal(state)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode segment state: %v", err)
+	}
+	thenOps = append(thenOps,
+		clientv3.OpPut(s.stateKey(result), string(value)),
+		clientv3.OpPut(s.ownerKey(result), s.ownerName, clientv3.WithLease(s.leaseID)),
+	)
+
+	// Execute the transaction
+	txnResp, err := txn.Then(thenOps...).Else(clientv3.OpGet(s.options.SegmentCountKey)).Commit()
+	if err != nil {
+		return 0, fmt.Errorf("transaction failed: %v", err)
+	}
+
+	if !txnResp.Succeeded {
+		// Transaction failed because remaining count changed
+		return 0, ErrSegmentConflict
+	}
+
+	s.held[result] = txnResp.Header.Revision
+
+	// print the remaining count
+	log.Println("Remaining segment count:", segmentCount-1)
+
+	return result, nil
+}
+
+// ReclaimSegment takes over a partially used segment whose owner key expired
+// with the lease of its instance
+func (s *EtcdIdSource) ReclaimSegment() (int, *segmentState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.available.Load() {
+		return 0, nil, errLeaseLost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.etcdOptions.RequestTimeout)
+	defer cancel()
+
+	prefix := s.options.SegmentStateKey + "/"
+	resp, err := s.etcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list segment states: %v", err)
+	}
+
+	for _, kv := range resp.Kvs {
+		segmentId, err := strconv.Atoi(strings.TrimPrefix(string(kv.Key), prefix))
+		if err != nil {
+			continue
+		}
+
+		var state segmentState
+		if err := json.Unmarshal(kv.Value, &state); err != nil {
+			log.Printf("Invalid state of segment %d: %v", segmentId, err)
+			continue
+		}
+		if state.Offset >= s.options.SegmentSize {
+			continue
+		}
+
+		// claim the segment if it has no owner and its state is unchanged
+		ownerKey := s.ownerKey(segmentId)
+		txnResp, err := s.etcdClient.Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.CreateRevision(ownerKey), "=", 0),
+				clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+			).
+			Then(clientv3.OpPut(ownerKey, s.ownerName, clientv3.WithLease(s.leaseID))).
+			Commit()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to claim segment %d: %v", segmentId, err)
+		}
+		if txnResp.Succeeded {
+			s.held[segmentId] = kv.ModRevision
+			return segmentId, &state, nil
+		}
+	}
+
+	return 0, nil, nil
+}
+
+func (s *EtcdIdSource) UpdateSegment(segmentId int, state segmentState) error {
+	return s.putOwnedState(segmentId, state)
+}
+
+func (s *EtcdIdSource) ReturnSegment(segmentId int, state segmentState) error {
+	err := s.putOwnedState(segmentId, state, clientv3.OpDelete(s.ownerKey(segmentId)))
+	if err == nil {
+		s.unhold(segmentId)
+	}
+	return err
+}
+
+func (s *EtcdIdSource) ReleaseSegment(segmentId int) error {
+	s.unhold(segmentId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.etcdOptions.RequestTimeout)
+	defer cancel()
+
+	_, err := s.etcdClient.Txn(ctx).Then(
+		clientv3.OpDelete(s.stateKey(segmentId)),
+		clientv3.OpDelete(s.ownerKey(segmentId)),
+	).Commit()
+	if err != nil {
+		// the state is left with a full offset, it is never reclaimed
+		return fmt.Errorf("failed to delete segment state: %v", err)
+	}
+
+	return nil
+}
+
+func (s *EtcdIdSource) RemainingSegments() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.etcdOptions.RequestTimeout)
+	defer cancel()
+
+	resp, err := s.etcdClient.Get(ctx, s.options.SegmentCountKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remaining count: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, fmt.Errorf("remaining count not found, generator not initialized")
+	}
+
+	return strconv.Atoi(string(resp.Kvs[0].Value))
+}
+
+// Available reports whether the source holds a lease, ids must not be handed
+// out while it is being re-acquired
+func (s *EtcdIdSource) Available() bool {
+	return s.available.Load()
+}
+
+// putOwnedState records the state of a segment if its owner key is still
+// attached to our lease
+func (s *EtcdIdSource) putOwnedState(segmentId int, state segmentState, ops ...clientv3.Op) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.available.Load() {
+		return errLeaseLost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.etcdOptions.RequestTimeout)
+	defer cancel()
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode segment state: %v", err)
+	}
+
+	txnResp, err := s.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.LeaseValue(s.ownerKey(segmentId)), "=", s.leaseID)).
+		Then(append([]clientv3.Op{clientv3.OpPut(s.stateKey(segmentId), string(value))}, ops...)...).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to update segment state: %v", err)
+	}
+	if !txnResp.Succeeded {
+		delete(s.held, segmentId)
+		return ErrSegmentNotOwned
+	}
+
+	s.held[segmentId] = txnResp.Header.Revision
+	return nil
+}
+
+// keepAlive drains the keepalive responses of the lease. When the lease is
+// lost peers may reclaim our segments, handing out more ids could duplicate
+// theirs, so the source is unavailable until a new lease is granted.
+func (s *EtcdIdSource) keepAlive(ctx context.Context, responses <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		for range responses {
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Println("Lost etcd lease of the id allocator, ids are unavailable until it is re-acquired")
+		s.available.Store(false)
+
+		delay := s.options.RetryBaseDelay
+		for {
+			var err error
+			responses, err = s.renewLease(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Println("failed to re-acquire etcd lease:", err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, s.options.RetryMaxDelay)
+		}
+	}
+}
+
+// renewLease grants a new lease and moves the owner keys of the held
+// segments to it. A segment reclaimed by a peer in the meantime is dropped,
+// the allocator gets ErrSegmentNotOwned on its next update of the segment.
+func (s *EtcdIdSource) renewLease(ctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requestCtx, cancel := context.WithTimeout(ctx, s.etcdOptions.RequestTimeout)
+	defer cancel()
+
+	lease, err := s.etcdClient.Grant(requestCtx, int64(s.options.LeaseTTL.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant lease: %v", err)
+	}
+
+	// on failure the owner keys already moved to the new lease are deleted
+	// with it, so the next attempt claims them again
+	renewed := false
+	defer func() {
+		if !renewed {
+			revokeCtx, cancel := context.WithTimeout(context.Background(), s.etcdOptions.RequestTimeout)
+			defer cancel()
+			if _, err := s.etcdClient.Revoke(revokeCtx, lease.ID); err != nil {
+				log.Println("failed to revoke etcd lease:", err)
+			}
+		}
+	}()
+
+	for segmentId, revision := range s.held {
+		ownerKey := s.ownerKey(segmentId)
+		owner := clientv3.OpPut(ownerKey, s.ownerName, clientv3.WithLease(lease.ID))
+
+		// the owner key is still attached to the old lease if it did not
+		// expire on the server yet
+		txnResp, err := s.etcdClient.Txn(requestCtx).
+			If(clientv3.Compare(clientv3.LeaseValue(ownerKey), "=", s.leaseID)).
+			Then(owner).
+			Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hold segment %d: %v", segmentId, err)
+		}
+		if txnResp.Succeeded {
+			continue
+		}
+
+		// otherwise the segment is claimed again if no peer reclaimed it,
+		// like ReclaimSegment does
+		txnResp, err = s.etcdClient.Txn(requestCtx).
+			If(
+				clientv3.Compare(clientv3.CreateRevision(ownerKey), "=", 0),
+				clientv3.Compare(clientv3.ModRevision(s.stateKey(segmentId)), "=", revision),
+			).
+			Then(owner).
+			Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to reclaim segment %d: %v", segmentId, err)
+		}
+		if !txnResp.Succeeded {
+			log.Printf("Lost segment %d to a peer", segmentId)
+			delete(s.held, segmentId)
+		}
+	}
+
+	responses, err := s.etcdClient.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to keep lease alive: %v", err)
+	}
+
+	renewed = true
+	s.leaseID = lease.ID
+	s.available.Store(true)
+	log.Printf("Re-acquired etcd lease, holding %d segments", len(s.held))
+
+	return responses, nil
+}
+
+func (s *EtcdIdSource) lease() clientv3.LeaseID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.leaseID
+}
+
+func (s *EtcdIdSource) unhold(segmentId int) {
+	s.lock.Lock()
+	delete(s.held, segmentId)
+	s.lock.Unlock()
+}
+
+func (s *EtcdIdSource) stateKey(segmentId int) string {
+	return fmt.Sprintf("%s/%d", s.options.SegmentStateKey, segmentId)
+}
+
+func (s *EtcdIdSource) ownerKey(segmentId int) string {
+	return fmt.Sprintf("%s/%d", s.options.SegmentOwnerKey, segmentId)
+}
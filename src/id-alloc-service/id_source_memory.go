@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// MemoryIdSource allocates segments in memory. Segments are unique within
+// the process only, it is meant for local development with a single instance.
+type MemoryIdSource struct {
+	lock         sync.Mutex
+	segmentCount int                  // number of segments never allocated
+	remap        map[int]int          // Fisher-Yates remap of the remaining segments
+	states       map[int]segmentState // state of the held segments
+	owned        map[int]bool         // whether a held segment is owned
+	options      *IdAllocatorOptions
+}
+
+func NewMemoryIdSource(options *IdAllocatorOptions) *MemoryIdSource {
+	return &MemoryIdSource{
+		segmentCount: options.MaxSegmentCount,
+		remap:        make(map[int]int),
+		states:       make(map[int]segmentState),
+		owned:        make(map[int]bool),
+		options:      options,
+	}
+}
+
+func (s *MemoryIdSource) AllocateSegment(state segmentState) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.segmentCount <= 0 {
+		return 0, ErrSegmentsExhausted
+	}
+
+	// swap the picked segment with the last remaining one
+	index := rand.Intn(s.segmentCount) + 1
+	result, ok := s.remap[index]
+	if !ok {
+		result = index
+	}
+
+	last, ok := s.remap[s.segmentCount]
+	if !ok {
+		last = s.segmentCount
+	}
+	s.remap[index] = last
+	delete(s.remap, s.segmentCount)
+	s.segmentCount--
+
+	s.states[result] = state
+	s.owned[result] = true
+
+	return result, nil
+}
+
+func (s *MemoryIdSource) ReclaimSegment() (int, *segmentState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for segmentId, state := range s.states {
+		if s.owned[segmentId] || state.Offset >= s.options.SegmentSize {
+			continue
+		}
+
+		s.owned[segmentId] = true
+		return segmentId, &state, nil
+	}
+
+	return 0, nil, nil
+}
+
+func (s *MemoryIdSource) UpdateSegment(segmentId int, state segmentState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.owned[segmentId] {
+		return ErrSegmentNotOwned
+	}
+
+	s.states[segmentId] = state
+	return nil
+}
+
+func (s *MemoryIdSource) ReturnSegment(segmentId int, state segmentState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.owned[segmentId] {
+		return ErrSegmentNotOwned
+	}
+
+	s.states[segmentId] = state
+	delete(s.owned, segmentId)
+	return nil
+}
+
+func (s *MemoryIdSource) ReleaseSegment(segmentId int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.states, segmentId)
+	delete(s.owned, segmentId)
+	return nil
+}
+
+func (s *MemoryIdSource) RemainingSegments() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.segmentCount, nil
+}
+
+// Available always holds, the segments are never lost within the process
+func (s *MemoryIdSource) Available() bool {
+	return true
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisIdSource allocates segments with a Fisher-Yates shuffle scripted in
+// Lua. Held segments have an owner key expiring after the lease TTL, it is
+// renewed while the instance is alive. The scripts build owner keys from
+// their arguments, so the keys must live on a single Redis master.
+type RedisIdSource struct {
+	redisClient  *redis.Client
+	token        string // value of the owner keys of this instance
+	lock         sync.Mutex
+	held         map[int]struct{} // segments owned by this instance
+	options      *IdAllocatorOptions
+	cacheOptions *cache.Options
+}
+
+// allocateSegmentScript picks a random remaining segment, moves the last
+// remaining one into its slot and holds the picked segment. It returns 0
+// when every segment has been allocated.
+var allocateSegmentScript = redis.NewScript(`
+local count = tonumber(redis.call("GET", KEYS[1]) or ARGV[1])
+if count <= 0 then
+  return 0
+end
+
+local index = tonumber(ARGV[2]) % count + 1
+local result = tonumber(redis.call("HGET", KEYS[2], index) or index)
+local last = redis.call("HGET", KEYS[2], count) or count
+redis.call("HSET", KEYS[2], index, last)
+redis.call("HDEL", KEYS[2], count)
+redis.call("SET", KEYS[1], count - 1)
+
+redis.call("HSET", KEYS[3], result, ARGV[3])
+redis.call("SET", ARGV[4] .. result, ARGV[5], "PX", ARGV[6])
+return result
+`)
+
+// reclaimSegmentScript holds a segment if it has no owner and its state is
+// unchanged
+var reclaimSegmentScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 then
+  return 0
+end
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2] then
+  return 0
+end
+redis.call("SET", KEYS[2], ARGV[3], "PX", ARGV[4])
+return 1
+`)
+
+// updateSegmentScript records the state of a segment if it is still owned
+// by the caller, and gives up the ownership when ARGV[5] is "1"
+var updateSegmentScript = redis.NewScript(`
+if redis.call("GET", KEYS[2]) ~= ARGV[3] then
+  return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+if ARGV[5] == "1" then
+  redis.call("DEL", KEYS[2])
+else
+  redis.call("PEXPIRE", KEYS[2], ARGV[4])
+end
+return 1
+`)
+
+// renewOwnerScript extends the owner key of a segment if it is still owned
+// by the caller
+var renewOwnerScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+func NewRedisIdSource(idAllocOptions *IdAllocatorOptions, cacheClient *cache.Client) (*RedisIdSource, func(), error) {
+	suffix, err := codec.RandomHex(8)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	source := &RedisIdSource{
+		redisClient:  cacheClient.Redis(),
+		token:        hostname + "/" + suffix,
+		held:         make(map[int]struct{}),
+		options:      idAllocOptions,
+		cacheOptions: cacheClient.Options(),
+	}
+
+	log.Println("Allocating segments from Redis")
+
+	// renew the owner keys well before they expire
+	ticker := time.NewTicker(idAllocOptions.LeaseTTL / 3)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				source.renew()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return source, func() {
+		ticker.Stop()
+		close(done)
+
+		// expire the owner keys so peers can reclaim our segments right away
+		source.lock.Lock()
+		defer source.lock.Unlock()
+		for segmentId := range source.held {
+			ctx, cancel := context.WithTimeout(context.Background(), source.cacheOptions.SetTimeout)
+			err := renewOwnerScript.Run(ctx, source.redisClient, []string{source.ownerKey(segmentId)}, source.token, 1).Err()
+			cancel()
+			if err != nil {
+				log.Printf("Error giving up segment %d: %v", segmentId, err)
+			}
+		}
+	}, nil
+}
+
+func (s *RedisIdSource) AllocateSegment(state segmentState) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cacheOptions.SetTimeout)
+	defer cancel()
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode segment state: %v", err)
+	}
+
+	// Lua numbers are doubles, keep the random index exact
+	keys := []string{s.options.SegmentCountKey, s.options.SegmentMapKey, s.options.SegmentStateKey}
+	result, err := allocateSegmentScript.Run(ctx, s.redisClient, keys,
+		s.options.MaxSegmentCount, rand.Int63n(1<<53), value, s.options.SegmentOwnerKey+"/", s.token,
+		s.options.LeaseTTL.Milliseconds()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate segment in Redis: %v", err)
+	}
+	if result == 0 {
+		return 0, ErrSegmentsExhausted
+	}
+
+	s.hold(result)
+	return result, nil
+}
+
+func (s *RedisIdSource) ReclaimSegment() (int, *segmentState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cacheOptions.SetTimeout)
+	defer cancel()
+
+	states, err := s.redisClient.HGetAll(ctx, s.options.SegmentStateKey).Result()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list segment states: %v", err)
+	}
+
+	for field, value := range states {
+		segmentId, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+
+		var state segmentState
+		if err := json.Unmarshal([]byte(value), &state); err != nil {
+			log.Printf("Invalid state of segment %d: %v", segmentId, err)
+			continue
+		}
+		if state.Offset >= s.options.SegmentSize {
+			continue
+		}
+
+		keys := []string{s.options.SegmentStateKey, s.ownerKey(segmentId)}
+		claimed, err := reclaimSegmentScript.Run(ctx, s.redisClient, keys,
+			segmentId, value, s.token, s.options.LeaseTTL.Milliseconds()).Int()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to claim segment %d: %v", segmentId, err)
+		}
+		if claimed == 1 {
+			s.hold(segmentId)
+			return segmentId, &state, nil
+		}
+	}
+
+	return 0, nil, nil
+}
+
+func (s *RedisIdSource) UpdateSegment(segmentId int, state segmentState) error {
+	return s.updateSegment(segmentId, state, false)
+}
+
+func (s *RedisIdSource) ReturnSegment(segmentId int, state segmentState) error {
+	if err := s.updateSegment(segmentId, state, true); err != nil {
+		return err
+	}
+
+	s.unhold(segmentId)
+	return nil
+}
+
+func (s *RedisIdSource) ReleaseSegment(segmentId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cacheOptions.SetTimeout)
+	defer cancel()
+
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, s.options.SegmentStateKey, strconv.Itoa(segmentId))
+		pipe.Del(ctx, s.ownerKey(segmentId))
+		return nil
+	})
+	if err != nil {
+		// the state is left with a full offset, it is never reclaimed
+		return fmt.Errorf("failed to delete segment state: %v", err)
+	}
+
+	s.unhold(segmentId)
+	return nil
+}
+
+func (s *RedisIdSource) updateSegment(segmentId int, state segmentState, giveUp bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cacheOptions.SetTimeout)
+	defer cancel()
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode segment state: %v", err)
+	}
+
+	giveUpArg := "0"
+	if giveUp {
+		giveUpArg = "1"
+	}
+
+	keys := []string{s.options.SegmentStateKey, s.ownerKey(segmentId)}
+	updated, err := updateSegmentScript.Run(ctx, s.redisClient, keys,
+		segmentId, value, s.token, s.options.LeaseTTL.Milliseconds(), giveUpArg).Int()
+	if err != nil {
+		return fmt.Errorf("failed to update segment state: %v", err)
+	}
+	if updated == 0 {
+		return ErrSegmentNotOwned
+	}
+
+	return nil
+}
+
+func (s *RedisIdSource) RemainingSegments() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cacheOptions.SetTimeout)
+	defer cancel()
+
+	count, err := s.redisClient.Get(ctx, s.options.SegmentCountKey).Int()
+	if err == redis.Nil {
+		// the count is initialized by the first allocation
+		return s.options.MaxSegmentCount, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remaining count: %v", err)
+	}
+
+	return count, nil
+}
+
+// Available always holds, the process exits when the ownership of a held
+// segment is lost
+func (s *RedisIdSource) Available() bool {
+	return true
+}
+
+// renew extends the owner keys of the held segments
+func (s *RedisIdSource) renew() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for segmentId := range s.held {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cacheOptions.SetTimeout)
+		renewed, err := renewOwnerScript.Run(ctx, s.redisClient, []string{s.ownerKey(segmentId)},
+			s.token, s.options.LeaseTTL.Milliseconds()).Int()
+		cancel()
+
+		if err != nil {
+			log.Printf("Error renewing segment %d: %v", segmentId, err)
+			continue
+		}
+		// the owner key expired and peers may reclaim the segment, handing
+		// out more ids could duplicate theirs
+		if renewed == 0 {
+			log.Fatalf("lost ownership of segment %d", segmentId)
+		}
+	}
+}
+
+func (s *RedisIdSource) hold(segmentId int) {
+	s.lock.Lock()
+	s.held[segmentId] = struct{}{}
+	s.lock.Unlock()
+}
+
+func (s *RedisIdSource) unhold(segmentId int) {
+	s.lock.Lock()
+	delete(s.held, segmentId)
+	s.lock.Unlock()
+}
+
+func (s *RedisIdSource) ownerKey(segmentId int) string {
+	return fmt.Sprintf("%s/%d", s.options.SegmentOwnerKey, segmentId)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/codec"
+)
+
+// idSourceBackend creates sources of one backend. Sources created from the
+// same options share their segments when shared is set, like the instances
+// of a deployment do.
+type idSourceBackend struct {
+	name      string
+	shared    bool
+	newSource func(t *testing.T, options *IdAllocatorOptions) IdSource
+}
+
+// idSourceBackends returns the memory backend, and the etcd and Redis ones
+// when ETCD_ADDRESS and REDIS_SENTINEL_ADDRESS are set
+func idSourceBackends(t *testing.T) []idSourceBackend {
+	backends := []idSourceBackend{{
+		name: "memory",
+		newSource: func(t *testing.T, options *IdAllocatorOptions) IdSource {
+			return NewMemoryIdSource(options)
+		},
+	}}
+
+	if address := os.Getenv("ETCD_ADDRESS"); address != "" {
+		backends = append(backends, idSourceBackend{
+			name:   "etcd",
+			shared: true,
+			newSource: func(t *testing.T, options *IdAllocatorOptions) IdSource {
+				source, cleanup, err := NewEtcdIdSource(options, &EtcdOptions{
+					Address:        address,
+					ConnectTimeout: 5 * time.Second,
+					RequestTimeout: 5 * time.Second,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(cleanup)
+				return source
+			},
+		})
+	}
+
+	if address := os.Getenv("REDIS_SENTINEL_ADDRESS"); address != "" {
+		masterName := os.Getenv("REDIS_MASTER_NAME")
+		if masterName == "" {
+			masterName = "mymaster"
+		}
+		backends = append(backends, idSourceBackend{
+			name:   "redis",
+			shared: true,
+			newSource: func(t *testing.T, options *IdAllocatorOptions) IdSource {
+				cacheClient, cleanup, err := cache.NewClient(&cache.Options{
+					SentinelAddress: address,
+					MasterName:      masterName,
+					Password:        os.Getenv("REDIS_PASSWORD"),
+					ConnectTimeout:  5 * time.Second,
+					SetTimeout:      5 * time.Second,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(cleanup)
+
+				source, cleanup, err := NewRedisIdSource(options, cacheClient)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(cleanup)
+				return source
+			},
+		})
+	}
+
+	return backends
+}
+
+// testIdSourceOptions returns options whose keys are not used by any other
+// test, so runs against a shared etcd or Redis start from a clean state
+func testIdSourceOptions(t *testing.T, maxSegmentCount int) *IdAllocatorOptions {
+	suffix, err := codec.RandomHex(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "test/" + suffix + "/"
+
+	return &IdAllocatorOptions{
+		SegmentSize:     1000,
+		SegmentCountKey: prefix + "segment_count",
+		SegmentMapKey:   prefix + "segment_map",
+		SegmentAllocKey: prefix + "segment_alloc",
+		SegmentStateKey: prefix + "segment_state",
+		SegmentOwnerKey: prefix + "segment_owner",
+		MaxSegmentCount: maxSegmentCount,
+		LeaseTTL:        10 * time.Second,
+		RetryBaseDelay:  10 * time.Millisecond,
+		RetryMaxDelay:   time.Second,
+	}
+}
+
+// allocateSegment allocates a segment, retrying the allocations lost to a
+// concurrent one
+func allocateSegment(source IdSource, state segmentState) (int, error) {
+	for {
+		segmentId, err := source.AllocateSegment(state)
+		if !errors.Is(err, ErrSegmentConflict) {
+			return segmentId, err
+		}
+	}
+}
+
+func TestIdSourceConcurrentAllocation(t *testing.T) {
+	for _, backend := range idSourceBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			const segmentCount = 200
+			const workers = 16
+
+			options := testIdSourceOptions(t, segmentCount)
+
+			// every worker has its own instance when the backend is shared
+			sources := make([]IdSource, workers)
+			for i := range sources {
+				if i == 0 || backend.shared {
+					sources[i] = backend.newSource(t, options)
+				} else {
+					sources[i] = sources[0]
+				}
+			}
+
+			var lock sync.Mutex
+			var segmentIds []int
+			var wg sync.WaitGroup
+			for _, source := range sources {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						segmentId, err := allocateSegment(source, segmentState{Seed: 1})
+						if errors.Is(err, ErrSegmentsExhausted) {
+							return
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						lock.Lock()
+						segmentIds = append(segmentIds, segmentId)
+						lock.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			// every segment of [1, segmentCount] is handed out exactly once
+			sort.Ints(segmentIds)
+			if len(segmentIds) != segmentCount {
+				t.Fatalf("allocated %d segments, want %d", len(segmentIds), segmentCount)
+			}
+			for i, segmentId := range segmentIds {
+				if segmentId != i+1 {
+					t.Fatalf("segment %d allocated twice or out of range", segmentId)
+				}
+			}
+
+			remaining, err := sources[0].RemainingSegments()
+			if err != nil || remaining != 0 {
+				t.Errorf("RemainingSegments() = %d, %v, want 0", remaining, err)
+			}
+			if _, err := allocateSegment(sources[0], segmentState{}); !errors.Is(err, ErrSegmentsExhausted) {
+				t.Errorf("AllocateSegment() error = %v, want ErrSegmentsExhausted", err)
+			}
+		})
+	}
+}
+
+func TestIdSourceOwnership(t *testing.T) {
+	for _, backend := range idSourceBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			options := testIdSourceOptions(t, 10)
+			source := backend.newSource(t, options)
+
+			segmentId, err := allocateSegment(source, segmentState{Seed: 7, Mode: PermutationFeistel, Offset: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining, err := source.RemainingSegments(); err != nil || remaining != 9 {
+				t.Errorf("RemainingSegments() = %d, %v, want 9", remaining, err)
+			}
+
+			// a held segment is not reclaimable
+			if reclaimed, _, err := source.ReclaimSegment(); err != nil || reclaimed != 0 {
+				t.Fatalf("ReclaimSegment() = %d, %v, want no segment", reclaimed, err)
+			}
+
+			if err := source.UpdateSegment(segmentId, segmentState{Seed: 7, Mode: PermutationFeistel, Offset: 20}); err != nil {
+				t.Fatal(err)
+			}
+			if err := source.ReturnSegment(segmentId, segmentState{Seed: 7, Mode: PermutationFeistel, Offset: 30}); err != nil {
+				t.Fatal(err)
+			}
+
+			// a returned segment is no longer owned
+			if err := source.UpdateSegment(segmentId, segmentState{Seed: 7, Offset: 40}); !errors.Is(err, ErrSegmentNotOwned) {
+				t.Errorf("UpdateSegment() of a returned segment error = %v, want ErrSegmentNotOwned", err)
+			}
+			if err := source.ReturnSegment(segmentId, segmentState{Seed: 7, Offset: 40}); !errors.Is(err, ErrSegmentNotOwned) {
+				t.Errorf("ReturnSegment() of a returned segment error = %v, want ErrSegmentNotOwned", err)
+			}
+
+			// it is reclaimed from its returned state
+			reclaimed, state, err := source.ReclaimSegment()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reclaimed != segmentId || state == nil || *state != (segmentState{Seed: 7, Mode: PermutationFeistel, Offset: 30}) {
+				t.Fatalf("ReclaimSegment() = %d, %+v, want %d at offset 30", reclaimed, state, segmentId)
+			}
+			if err := source.UpdateSegment(segmentId, segmentState{Seed: 7, Mode: PermutationFeistel, Offset: 40}); err != nil {
+				t.Errorf("UpdateSegment() of a reclaimed segment error = %v", err)
+			}
+
+			// another instance can neither update nor reclaim it
+			if backend.shared {
+				peer := backend.newSource(t, options)
+				if err := peer.UpdateSegment(segmentId, segmentState{Seed: 7, Offset: 50}); !errors.Is(err, ErrSegmentNotOwned) {
+					t.Errorf("UpdateSegment() by a peer error = %v, want ErrSegmentNotOwned", err)
+				}
+				if reclaimed, _, err := peer.ReclaimSegment(); err != nil || reclaimed != 0 {
+					t.Errorf("ReclaimSegment() by a peer = %d, %v, want no segment", reclaimed, err)
+				}
+			}
+
+			// a used up segment is never reclaimed
+			if err := source.ReturnSegment(segmentId, segmentState{Seed: 7, Offset: options.SegmentSize}); err != nil {
+				t.Fatal(err)
+			}
+			if reclaimed, _, err := source.ReclaimSegment(); err != nil || reclaimed != 0 {
+				t.Errorf("ReclaimSegment() = %d, %v, want no segment", reclaimed, err)
+			}
+
+			// a released segment is forgotten
+			other, err := allocateSegment(source, segmentState{Seed: 8})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := source.ReleaseSegment(other); err != nil {
+				t.Fatal(err)
+			}
+			if err := source.UpdateSegment(other, segmentState{Seed: 8, Offset: 1}); !errors.Is(err, ErrSegmentNotOwned) {
+				t.Errorf("UpdateSegment() of a released segment error = %v, want ErrSegmentNotOwned", err)
+			}
+			if reclaimed, _, err := source.ReclaimSegment(); err != nil || reclaimed != 0 {
+				t.Errorf("ReclaimSegment() = %d, %v, want no segment", reclaimed, err)
+			}
+		})
+	}
+}
+
+// TestEtcdIdSourceLeaseLoss checks that a source whose lease is lost holds
+// its segments again under a new lease
+func TestEtcdIdSourceLeaseLoss(t *testing.T) {
+	address := os.Getenv("ETCD_ADDRESS")
+	if address == "" {
+		t.Skip("ETCD_ADDRESS is not set")
+	}
+
+	options := testIdSourceOptions(t, 10)
+	source, cleanup, err := NewEtcdIdSource(options, &EtcdOptions{
+		Address:        address,
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	segmentId, err := allocateSegment(source, segmentState{Seed: 7, Offset: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// revoking the lease deletes the owner keys, like an expiry does
+	lost := source.lease()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := source.etcdClient.Revoke(ctx, lost); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !source.Available() || source.lease() == lost {
+		if time.Now().After(deadline) {
+			t.Fatal("lease not re-acquired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := source.UpdateSegment(segmentId, segmentState{Seed: 7, Offset: 20}); err != nil {
+		t.Errorf("UpdateSegment() after the lease is re-acquired error = %v", err)
+	}
+	if reclaimed, _, err := source.ReclaimSegment(); err != nil || reclaimed != 0 {
+		t.Errorf("ReclaimSegment() = %d, %v, want no segment", reclaimed, err)
+	}
+}
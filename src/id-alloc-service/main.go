@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/id-alloc-service/idallocpb"
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/config"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type ServerOptions struct {
+	GRPCPort        string        `mapstructure:"grpc_port"`        // port the gRPC server listens on
+	HTTPPort        string        `mapstructure:"http_port"`        // port of /health and /metrics
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"` // maximum time to drain in-flight requests on shutdown
+	MaxBatchSize    int           `mapstructure:"max_batch_size"`   // maximum number of ids of an AllocateBatch request
+}
+
+func main() {
+
+	// load configuration
+	v, err := config.Load()
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
+
+	// bind to IdAllocatorOptions, the defaults of every namespace
+	var idAllocOptions IdAllocatorOptions
+	if err := v.UnmarshalKey("id_alloc", &idAllocOptions); err != nil {
+		log.Fatal("Error unmarshalling ID Allocator options: ", err)
+	}
+
+	if idAllocOptions.ReserveSize <= 0 {
+		idAllocOptions.ReserveSize = 1000
+	}
+	if idAllocOptions.LeaseTTL <= 0 {
+		idAllocOptions.LeaseTTL = 10 * time.Second
+	}
+	if idAllocOptions.RetryAttempts <= 0 {
+		idAllocOptions.RetryAttempts = 5
+	}
+	if idAllocOptions.RetryBaseDelay <= 0 {
+		idAllocOptions.RetryBaseDelay = 50 * time.Millisecond
+	}
+	if idAllocOptions.RetryMaxDelay <= 0 {
+		idAllocOptions.RetryMaxDelay = 2 * time.Second
+	}
+	if idAllocOptions.RetryTimeout <= 0 {
+		idAllocOptions.RetryTimeout = 10 * time.Second
+	}
+	if idAllocOptions.Generation == 0 {
+		idAllocOptions.Generation = 1
+	}
+	if idAllocOptions.ExhaustionWarn == nil {
+		idAllocOptions.ExhaustionWarn = []float64{0.2, 0.1, 0.05, 0.01}
+	}
+	if idAllocOptions.Source == "" {
+		idAllocOptions.Source = "etcd"
+	}
+	if idAllocOptions.Permutation == "" {
+		idAllocOptions.Permutation = PermutationShuffle
+	}
+
+	// bind to the namespaces, every namespace overrides the id_alloc defaults
+	// and gets its own keyspace
+	namespaces := v.GetStringMap("namespaces")
+	if len(namespaces) == 0 {
+		log.Fatal("Error in namespaces options: no namespace configured")
+	}
+
+	namespaceOptions := make(map[string]*IdAllocatorOptions, len(namespaces))
+	for namespace := range namespaces {
+		options := idAllocOptions
+		if err := v.UnmarshalKey("namespaces."+namespace, &options); err != nil {
+			log.Fatalf("Error unmarshalling options of namespace %s: %v", namespace, err)
+		}
+
+		// the keys are prefixed with "<namespace>/" unless key_prefix is set,
+		// an empty prefix keeps the keys of the allocator before namespaces
+		prefix := namespace + "/"
+		if v.IsSet("namespaces." + namespace + ".key_prefix") {
+			prefix = v.GetString("namespaces." + namespace + ".key_prefix")
+		}
+		options.ApplyKeyPrefix(prefix)
+
+		if err := options.ApplyGeneration(); err != nil {
+			log.Fatalf("Error in options of namespace %s: %v", namespace, err)
+		}
+		switch options.Source {
+		case "etcd", "redis", "memory":
+		default:
+			log.Fatalf("Error in options of namespace %s: unknown source %s", namespace, options.Source)
+		}
+		switch options.Permutation {
+		case PermutationShuffle, PermutationFeistel:
+		default:
+			log.Fatalf("Error in options of namespace %s: unknown permutation %s", namespace, options.Permutation)
+		}
+
+		namespaceOptions[namespace] = &options
+	}
+
+	// bind to EtcdOptions
+	var etcdOptions EtcdOptions
+	if err := v.UnmarshalKey("etcd", &etcdOptions); err != nil {
+		log.Fatal("Error unmarshalling Etcd options: ", err)
+	}
+
+	etcdOptions.Address = os.Getenv("ETCD_ADDRESS")
+
+	// bind to cache.Options
+	cacheOptions, err := config.CacheOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Cache options: ", err)
+	}
+
+	// bind to ServerOptions
+	var serverOptions ServerOptions
+	if err := v.UnmarshalKey("server", &serverOptions); err != nil {
+		log.Fatal("Error unmarshalling Server options: ", err)
+	}
+
+	if serverOptions.GRPCPort == "" {
+		serverOptions.GRPCPort = "9090"
+	}
+	if serverOptions.HTTPPort == "" {
+		serverOptions.HTTPPort = "8080"
+	}
+	if serverOptions.ShutdownTimeout <= 0 {
+		serverOptions.ShutdownTimeout = 10 * time.Second
+	}
+	if serverOptions.MaxBatchSize <= 0 {
+		serverOptions.MaxBatchSize = 10000
+	}
+
+	// init the allocator of every namespace, a source is closed after its
+	// allocator returns its segments
+	var cacheClient *cache.Client
+	allocators := make(map[string]*IdAllocator, len(namespaceOptions))
+	for namespace, options := range namespaceOptions {
+		var idSource IdSource
+		switch options.Source {
+		case "etcd":
+			etcdIdSource, cleanup, err := NewEtcdIdSource(options, &etcdOptions)
+			if err != nil {
+				log.Fatalf("Error initializing etcd ID Source of namespace %s: %v", namespace, err)
+			}
+			defer cleanup()
+			idSource = etcdIdSource
+		case "redis":
+			// the namespaces share the connection to Redis
+			if cacheClient == nil {
+				var cleanup func()
+				cacheClient, cleanup, err = cache.NewClient(cacheOptions)
+				if err != nil {
+					log.Fatal("Error initializing Cache Client: ", err)
+				}
+				defer cleanup()
+			}
+			redisIdSource, cleanup, err := NewRedisIdSource(options, cacheClient)
+			if err != nil {
+				log.Fatalf("Error initializing Redis ID Source of namespace %s: %v", namespace, err)
+			}
+			defer cleanup()
+			idSource = redisIdSource
+		case "memory":
+			log.Printf("Allocating segments of namespace %s in memory, IDs are only unique within this instance", namespace)
+			idSource = NewMemoryIdSource(options)
+		}
+
+		idAllocator, cleanup, err := NewIdAllocator(options, idSource)
+		if err != nil {
+			log.Fatalf("Error initializing ID Allocator of namespace %s: %v", namespace, err)
+		}
+		defer cleanup()
+
+		allocators[namespace] = idAllocator
+		log.Printf("Serving namespace %s, generation %d", namespace, options.Generation)
+	}
+
+	idAllocServer := NewIdAllocServer(allocators, &serverOptions)
+
+	grpcServer := grpc.NewServer()
+	idallocpb.RegisterIdAllocatorServer(grpcServer, idAllocServer)
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+
+	listener, err := net.Listen("tcp", ":"+serverOptions.GRPCPort)
+	if err != nil {
+		log.Fatal("Error listening on gRPC port: ", err)
+	}
+
+	go func() {
+		log.Println("Starting gRPC server on port", serverOptions.GRPCPort)
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Fatal("Error starting gRPC server: ", err)
+		}
+	}()
+
+	// health check and Prometheus metrics of the allocators
+	router := func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/health":
+			ctx.SetStatusCode(fasthttp.StatusOK)
+			ctx.Write([]byte("OK"))
+		case "/metrics":
+			ctx.SetContentType("text/plain; version=0.0.4")
+			idAllocServer.WriteMetrics(ctx)
+		default:
+			ctx.Error("Not found", fasthttp.StatusNotFound)
+		}
+	}
+
+	server := &fasthttp.Server{Handler: router}
+
+	go func() {
+		log.Println("Starting HTTP server on port", serverOptions.HTTPPort)
+		if err := server.ListenAndServe(":" + serverOptions.HTTPPort); err != nil {
+			log.Fatal("Error starting HTTP server: ", err)
+		}
+	}()
+
+	// wait for a termination signal
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	// drain in-flight requests, the deferred cleanups then hand the unused ids
+	// back to the sources
+	log.Println("Shutting down server")
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(serverOptions.ShutdownTimeout):
+		log.Println("Error shutting down gRPC server: timed out draining requests")
+		grpcServer.Stop()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverOptions.ShutdownTimeout)
+	defer cancel()
+	if err := server.ShutdownWithContext(shutdownCtx); err != nil {
+		log.Println("Error shutting down HTTP server:", err)
+	}
+}
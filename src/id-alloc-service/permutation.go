@@ -0,0 +1,28 @@
+package main
+
+import "math/rand"
+
+// permutation modes of the ids of a segment
+const (
+	PermutationShuffle = "shuffle" // shuffled queue of the ids, O(segment_size) memory
+	PermutationFeistel = "feistel" // keyed Feistel permutation, O(1) memory
+)
+
+// permutation maps an offset in a segment to the 0-based id handed out at it,
+// implemented by codec.FeistelPermutation and shufflePermutation
+type permutation interface {
+	At(i int) int
+}
+
+// shufflePermutation is a shuffled slice of the ids
+type shufflePermutation []int
+
+// NewShufflePermutation shuffles [0, n), math/rand produces the same
+// sequence for a seed on every instance
+func NewShufflePermutation(n int, seed int64) shufflePermutation {
+	return rand.New(rand.NewSource(seed)).Perm(n)
+}
+
+func (p shufflePermutation) At(i int) int {
+	return p[i]
+}
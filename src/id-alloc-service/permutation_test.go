@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestShufflePermutation(t *testing.T) {
+	a := NewShufflePermutation(100, 3)
+	b := NewShufflePermutation(100, 3)
+
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		if a.At(i) != b.At(i) {
+			t.Fatalf("At(%d) differs for the same seed", i)
+		}
+		seen[a.At(i)] = true
+	}
+	if len(seen) != 100 {
+		t.Errorf("%d distinct ids, want 100", len(seen))
+	}
+}
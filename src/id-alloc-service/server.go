@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/qninhdt/chopurl/src/id-alloc-service/idallocpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IdAllocServer serves the allocators of the configured namespaces over gRPC
+type IdAllocServer struct {
+	idallocpb.UnimplementedIdAllocatorServer
+	allocators map[string]*IdAllocator
+	options    *ServerOptions
+}
+
+func NewIdAllocServer(allocators map[string]*IdAllocator, options *ServerOptions) *IdAllocServer {
+	return &IdAllocServer{
+		allocators: allocators,
+		options:    options,
+	}
+}
+
+func (s *IdAllocServer) Allocate(ctx context.Context, req *idallocpb.AllocateRequest) (*idallocpb.AllocateResponse, error) {
+	idAllocator, err := s.allocator(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := idAllocator.Pop()
+	if err != nil {
+		return nil, allocationStatus(req.Namespace, err)
+	}
+
+	return &idallocpb.AllocateResponse{Id: id}, nil
+}
+
+// AllocateBatch hands out all the ids or none, the ids handed out before a
+// failure are not handed out again
+func (s *IdAllocServer) AllocateBatch(ctx context.Context, req *idallocpb.AllocateBatchRequest) (*idallocpb.AllocateBatchResponse, error) {
+	idAllocator, err := s.allocator(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Count <= 0 || int(req.Count) > s.options.MaxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "count must be between 1 and %d", s.options.MaxBatchSize)
+	}
+
+	ids, err := idAllocator.PopN(int(req.Count))
+	if err != nil {
+		return nil, allocationStatus(req.Namespace, err)
+	}
+
+	return &idallocpb.AllocateBatchResponse{Ids: ids}, nil
+}
+
+func (s *IdAllocServer) Stats(ctx context.Context, req *idallocpb.StatsRequest) (*idallocpb.StatsResponse, error) {
+	idAllocator, err := s.allocator(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := idAllocator.Stats()
+	return &idallocpb.StatsResponse{
+		Generation:        int32(stats.Generation),
+		GenerationBase:    stats.GenerationBase,
+		SegmentSize:       int32(stats.SegmentSize),
+		SegmentsRemaining: stats.SegmentsRemaining,
+		SegmentsMax:       stats.SegmentsMax,
+		SegmentRemaining:  stats.SegmentRemaining,
+		NextSegmentReady:  stats.NextSegmentReady,
+		SegmentAttempts:   stats.Attempts,
+		SegmentConflicts:  stats.Conflicts,
+		SegmentFailures:   stats.Failures,
+		Unavailable:       stats.Unavailable,
+	}, nil
+}
+
+func (s *IdAllocServer) allocator(namespace string) (*IdAllocator, error) {
+	idAllocator, ok := s.allocators[namespace]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown namespace %q", namespace)
+	}
+	return idAllocator, nil
+}
+
+// allocationStatus maps an allocation error to a gRPC status, clients retry
+// Unavailable and raise the generation on ResourceExhausted
+func allocationStatus(namespace string, err error) error {
+	switch {
+	case errors.Is(err, ErrIdsUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrSegmentsExhausted):
+		log.Printf("Generation of namespace %s is exhausted, raise its generation", namespace)
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		log.Printf("Error allocating ID in namespace %s: %v", namespace, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// WriteMetrics writes the metrics of the allocators in the Prometheus text
+// format, labeled by namespace
+func (s *IdAllocServer) WriteMetrics(w io.Writer) {
+	namespaces := make([]string, 0, len(s.allocators))
+	for namespace := range s.allocators {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	stats := make([]IdAllocatorStats, len(namespaces))
+	for i, namespace := range namespaces {
+		stats[i] = s.allocators[namespace].Stats()
+	}
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(IdAllocatorStats) int64
+	}{
+		{"id_alloc_segment_attempts_total", "counter", "Segment request attempts.", func(s IdAllocatorStats) int64 { return s.Attempts }},
+		{"id_alloc_segment_conflicts_total", "counter", "Segment request attempts lost to a concurrent allocation.", func(s IdAllocatorStats) int64 { return s.Conflicts }},
+		{"id_alloc_segment_failures_total", "counter", "Segment requests failed after all retries.", func(s IdAllocatorStats) int64 { return s.Failures }},
+		{"id_alloc_unavailable_total", "counter", "Id allocations failed without an id.", func(s IdAllocatorStats) int64 { return s.Unavailable }},
+		{"id_alloc_segment_remaining", "gauge", "Ids left in the current segment.", func(s IdAllocatorStats) int64 { return s.SegmentRemaining }},
+		{"id_alloc_next_segment_ready", "gauge", "Whether the next segment has been requested.", func(s IdAllocatorStats) int64 {
+			if s.NextSegmentReady {
+				return 1
+			}
+			return 0
+		}},
+		{"id_alloc_segments_remaining", "gauge", "Segments of the generation never allocated.", func(s IdAllocatorStats) int64 { return s.SegmentsRemaining }},
+		{"id_alloc_segments_max", "gauge", "Segments of the generation.", func(s IdAllocatorStats) int64 { return s.SegmentsMax }},
+		{"id_alloc_generation", "gauge", "Generation of the allocated ids.", func(s IdAllocatorStats) int64 { return int64(s.Generation) }},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for i, namespace := range namespaces {
+			fmt.Fprintf(w, "%s{namespace=%q} %d\n", m.name, namespace, m.value(stats[i]))
+		}
+	}
+}
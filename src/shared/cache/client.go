@@ -0,0 +1,263 @@
+// Package cache is the Redis client of the short code cache. The shorten
+// service writes the cache and publishes invalidations, the redirect service
+// reads it and backfills misses.
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// notFoundMarker is cached in place of a long URL for codes that are known
+// not to exist, long URLs always start with a scheme so it cannot collide
+const notFoundMarker = "!404"
+
+// goneMarker is cached in place of a long URL for disabled, deleted or
+// expired links, the redirect service answers 410 Gone for it
+const goneMarker = "!410"
+
+// ErrCacheMiss is returned by GetURL for codes that are not cached
+var ErrCacheMiss = errors.New("URL not found in cache")
+
+// URLCache caches the long URLs of the short codes, scoped with
+// codec.DomainKey. Client caches them in Redis, MemoryCache in the process.
+type URLCache interface {
+	// GetURL returns the long URL of a code, ErrCacheMiss when it is not
+	// cached, model.ErrURLNotFound or model.ErrURLGone for cached results
+	GetURL(shortURL string) (string, error)
+	// GetURLWithTTL is GetURL that also returns the remaining lifetime of
+	// the entry, a negative duration when it never expires
+	GetURLWithTTL(shortURL string) (string, time.Duration, error)
+	AddURL(shortURL string, longURL string, expiration time.Duration) error
+	AddURLs(entries []Entry) []error
+	AddMissing(shortURL string, expiration time.Duration) error
+	AddGone(shortURL string, expiration time.Duration) error
+	PublishInvalidation(shortURLs ...string) error
+	SubscribeInvalidations(onInvalidate func(shortURL string)) func()
+}
+
+type Client struct {
+	redisClient *redis.Client
+	options     *Options
+}
+
+type Options struct {
+	SentinelAddress     string        `mapstructure:"sentinel_address"`     // sentinel address
+	MasterName          string        `mapstructure:"master_name"`          // master name
+	Password            string        `mapstructure:"password"`             // password
+	ConnectTimeout      time.Duration `mapstructure:"connect_timeout"`      // timeout of the initial ping
+	SetTimeout          time.Duration `mapstructure:"set_timeout"`          // timeout of a cache operation
+	URLTTL              time.Duration `mapstructure:"url_ttl"`              // maximum lifetime of a cached URL, 0 for no expiry
+	NegativeTTL         time.Duration `mapstructure:"negative_ttl"`         // lifetime of a cached not found result
+	InvalidationChannel string        `mapstructure:"invalidation_channel"` // pub/sub channel of updated or deleted short codes
+}
+
+func NewClient(options *Options) (*Client, func(), error) {
+	// set up a context with a timeout
+	ctx, cancel := context.WithTimeout(context.Background(), options.ConnectTimeout)
+	defer cancel()
+
+	// create a new Redis client with sentinel support
+	clientOptions := &redis.FailoverOptions{
+		MasterName:    options.MasterName,
+		SentinelAddrs: []string{options.SentinelAddress},
+		Password:      options.Password,
+	}
+
+	client := redis.NewFailoverClient(clientOptions)
+
+	// test the connection
+	_, err := client.Ping(ctx).Result()
+	if err != nil {
+		return nil, nil, errors.New("failed to connect to Redis Sentinel: " + err.Error())
+	}
+
+	log.Println("Connected to Redis Sentinel at", options.SentinelAddress)
+
+	cacheClient := &Client{
+		redisClient: client,
+		options:     options,
+	}
+
+	return cacheClient, func() {
+		if err := client.Close(); err != nil {
+			log.Println("failed to close Redis client:", err)
+		}
+	}, nil
+}
+
+// Redis returns the underlying client for the other structures kept in Redis
+func (c *Client) Redis() *redis.Client {
+	return c.redisClient
+}
+
+// Options returns the options the client was created with
+func (c *Client) Options() *Options {
+	return c.options
+}
+
+// GetURL retrieves a URL from the cache. Cached not found and gone results
+// are returned as model.ErrURLNotFound and model.ErrURLGone.
+func (c *Client) GetURL(shortURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.SetTimeout)
+	defer cancel()
+
+	longURL, err := c.redisClient.Get(ctx, shortURL).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", ErrCacheMiss
+		}
+		return "", errors.New("failed to get URL from Redis: " + err.Error())
+	}
+
+	switch longURL {
+	case notFoundMarker:
+		return "", model.ErrURLNotFound
+	case goneMarker:
+		return "", model.ErrURLGone
+	}
+
+	return longURL, nil
+}
+
+// GetURLWithTTL retrieves a URL and the remaining lifetime of its key in a
+// single round trip, so copies of the entry never outlive the link
+func (c *Client) GetURLWithTTL(shortURL string) (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.SetTimeout)
+	defer cancel()
+
+	pipe := c.redisClient.Pipeline()
+	getCmd := pipe.Get(ctx, shortURL)
+	ttlCmd := pipe.PTTL(ctx, shortURL)
+	// the error of every command is checked below
+	_, _ = pipe.Exec(ctx)
+
+	longURL, err := getCmd.Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", 0, ErrCacheMiss
+		}
+		return "", 0, errors.New("failed to get URL from Redis: " + err.Error())
+	}
+
+	switch longURL {
+	case notFoundMarker:
+		return "", 0, model.ErrURLNotFound
+	case goneMarker:
+		return "", 0, model.ErrURLGone
+	}
+
+	ttl, err := ttlCmd.Result()
+	if err != nil {
+		return "", 0, errors.New("failed to get TTL from Redis: " + err.Error())
+	}
+	if ttl == -2 {
+		// the key expired between the two commands
+		return "", 0, ErrCacheMiss
+	}
+	if ttl < 0 {
+		return longURL, -1, nil
+	}
+
+	return longURL, ttl, nil
+}
+
+// AddURL adds a URL to the cache with a specified expiration time
+func (c *Client) AddURL(shortURL string, longURL string, expiration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.SetTimeout)
+	defer cancel()
+
+	if err := c.redisClient.Set(ctx, shortURL, longURL, expiration).Err(); err != nil {
+		return errors.New("failed to set value in Redis: " + err.Error())
+	}
+
+	return nil
+}
+
+// Entry is a URL added by AddURLs
+type Entry struct {
+	Key        string
+	Value      string
+	Expiration time.Duration
+}
+
+// AddURLs adds many URLs in a single pipeline, it returns the error of every
+// entry in order
+func (c *Client) AddURLs(entries []Entry) []error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.SetTimeout)
+	defer cancel()
+
+	cmds := make([]*redis.StatusCmd, len(entries))
+	pipe := c.redisClient.Pipeline()
+	for i, entry := range entries {
+		cmds[i] = pipe.Set(ctx, entry.Key, entry.Value, entry.Expiration)
+	}
+	// the error of every command is checked below
+	_, _ = pipe.Exec(ctx)
+
+	errs := make([]error, len(entries))
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			errs[i] = errors.New("failed to set value in Redis: " + err.Error())
+		}
+	}
+	return errs
+}
+
+// AddMissing caches a not found result for a short code. It never overwrites
+// an existing entry, so a link created in the meantime is not hidden.
+func (c *Client) AddMissing(shortURL string, expiration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.SetTimeout)
+	defer cancel()
+
+	if err := c.redisClient.SetNX(ctx, shortURL, notFoundMarker, expiration).Err(); err != nil {
+		return errors.New("failed to set value in Redis: " + err.Error())
+	}
+
+	return nil
+}
+
+// AddGone caches a disabled, deleted or expired link
+func (c *Client) AddGone(shortURL string, expiration time.Duration) error {
+	return c.AddURL(shortURL, goneMarker, expiration)
+}
+
+// PublishInvalidation tells the redirect services to drop their local copies
+// of the given short codes
+func (c *Client) PublishInvalidation(shortURLs ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.SetTimeout)
+	defer cancel()
+
+	for _, shortURL := range shortURLs {
+		if err := c.redisClient.Publish(ctx, c.options.InvalidationChannel, shortURL).Err(); err != nil {
+			return errors.New("failed to publish invalidation to Redis: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// SubscribeInvalidations calls onInvalidate with every short code published
+// on the invalidation channel, the returned func stops the subscription
+func (c *Client) SubscribeInvalidations(onInvalidate func(shortURL string)) func() {
+	pubsub := c.redisClient.Subscribe(context.Background(), c.options.InvalidationChannel)
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			onInvalidate(msg.Payload)
+		}
+	}()
+
+	log.Println("Subscribed to invalidation channel", c.options.InvalidationChannel)
+
+	return func() {
+		if err := pubsub.Close(); err != nil {
+			log.Println("failed to close invalidation subscription:", err)
+		}
+	}
+}
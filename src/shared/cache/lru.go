@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU is a bounded in-process map of string values. Entries expire like
+// Redis keys, an expiration of 0 keeps an entry until it is evicted, and the
+// least recently used entry is evicted when the map is full. It is safe for
+// concurrent use.
+type LRU struct {
+	lock  sync.Mutex
+	items map[string]*list.Element
+	order *list.List // front is the most recently used entry
+	size  int        // maximum number of entries, 0 disables the map
+}
+
+type lruEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time // zero if the entry never expires
+}
+
+// NewLRU creates a map of at most size entries. A size of 0 disables it,
+// every lookup misses.
+func NewLRU(size int) *LRU {
+	return &LRU{
+		items: make(map[string]*list.Element, max(size, 0)),
+		order: list.New(),
+		size:  size,
+	}
+}
+
+// Get returns the value of a key if it is present and not expired, with its
+// remaining lifetime, -1 if it never expires like the PTTL of Redis. The
+// entry becomes the most recently used.
+func (c *LRU) Get(key string) (string, time.Duration, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	entry, ok := c.get(key, now)
+	if !ok {
+		return "", 0, false
+	}
+	if entry.expiresAt.IsZero() {
+		return entry.value, -1, true
+	}
+	return entry.value, entry.expiresAt.Sub(now), true
+}
+
+// Set adds or replaces the value of a key. An expiration of 0 keeps the
+// entry until it is evicted, a negative one removes the key.
+func (c *LRU) Set(key string, value string, expiration time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.set(key, value, expiration, time.Now())
+}
+
+// SetIfAbsent adds the value of a key only if the key is not present, like
+// SET NX of Redis. It reports whether the value was added.
+func (c *LRU) SetIfAbsent(key string, value string, expiration time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if _, ok := c.get(key, now); ok {
+		return false
+	}
+	c.set(key, value, expiration, now)
+	return true
+}
+
+// Delete removes a key
+func (c *LRU) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// Len returns the number of entries, expired entries not yet removed
+// included
+func (c *LRU) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *LRU) get(key string, now time.Time) (*lruEntry, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *LRU) set(key string, value string, expiration time.Duration, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	if expiration < 0 {
+		if elem, ok := c.items[key]; ok {
+			c.removeElement(elem)
+		}
+		return
+	}
+
+	var expiresAt time.Time
+	if expiration > 0 {
+		expiresAt = now.Add(expiration)
+	}
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *LRU) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry).key)
+}
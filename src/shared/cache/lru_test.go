@@ -0,0 +1,30 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUSetIfAbsent(t *testing.T) {
+	c := NewLRU(10)
+
+	if !c.SetIfAbsent("a", "A", time.Hour) {
+		t.Fatal("SetIfAbsent() of a missing key = false")
+	}
+	if c.SetIfAbsent("a", "B", time.Hour) {
+		t.Error("SetIfAbsent() of a present key = true")
+	}
+	if value, _, ok := c.Get("a"); !ok || value != "A" {
+		t.Errorf("Get(a) = %q, %v, want A", value, ok)
+	}
+
+	// an expired key is absent
+	c.Set("b", "B", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if !c.SetIfAbsent("b", "B2", 0) {
+		t.Error("SetIfAbsent() of an expired key = false")
+	}
+	if value, ttl, ok := c.Get("b"); !ok || value != "B2" || ttl != -1 {
+		t.Errorf("Get(b) = %q, %v, %v, want B2 without expiry", value, ttl, ok)
+	}
+}
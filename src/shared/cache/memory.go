@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+// MemoryCache is a URLCache kept in the process, for single process
+// deployments. Entries are kept in an LRU, they expire like Redis keys and
+// invalidations are only delivered to the subscribers of the process.
+type MemoryCache struct {
+	lru         *LRU
+	lock        sync.Mutex // guards the subscribers
+	subscribers map[int]func(shortURL string)
+	nextID      int
+}
+
+// NewMemoryCache creates a cache of at most size entries. A size of 0
+// disables caching, every lookup misses.
+func NewMemoryCache(size int) *MemoryCache {
+	return &MemoryCache{
+		lru:         NewLRU(size),
+		subscribers: make(map[int]func(shortURL string)),
+	}
+}
+
+func (c *MemoryCache) GetURL(shortURL string) (string, error) {
+	longURL, _, err := c.GetURLWithTTL(shortURL)
+	return longURL, err
+}
+
+// GetURLWithTTL returns a URL with its remaining lifetime, -1 if it never
+// expires, like Client.GetURLWithTTL
+func (c *MemoryCache) GetURLWithTTL(shortURL string) (string, time.Duration, error) {
+	longURL, ttl, ok := c.lru.Get(shortURL)
+	if !ok {
+		return "", 0, ErrCacheMiss
+	}
+
+	switch longURL {
+	case notFoundMarker:
+		return "", 0, model.ErrURLNotFound
+	case goneMarker:
+		return "", 0, model.ErrURLGone
+	}
+
+	return longURL, ttl, nil
+}
+
+// AddURL caches a URL, an expiration of 0 keeps it until it is evicted
+func (c *MemoryCache) AddURL(shortURL string, longURL string, expiration time.Duration) error {
+	c.lru.Set(shortURL, longURL, expiration)
+	return nil
+}
+
+func (c *MemoryCache) AddURLs(entries []Entry) []error {
+	for _, entry := range entries {
+		c.lru.Set(entry.Key, entry.Value, entry.Expiration)
+	}
+	return make([]error, len(entries))
+}
+
+// AddMissing caches a not found result for a short code, it never
+// overwrites an existing entry
+func (c *MemoryCache) AddMissing(shortURL string, expiration time.Duration) error {
+	c.lru.SetIfAbsent(shortURL, notFoundMarker, expiration)
+	return nil
+}
+
+func (c *MemoryCache) AddGone(shortURL string, expiration time.Duration) error {
+	return c.AddURL(shortURL, goneMarker, expiration)
+}
+
+func (c *MemoryCache) PublishInvalidation(shortURLs ...string) error {
+	c.lock.Lock()
+	subscribers := make([]func(shortURL string), 0, len(c.subscribers))
+	for _, onInvalidate := range c.subscribers {
+		subscribers = append(subscribers, onInvalidate)
+	}
+	c.lock.Unlock()
+
+	for _, shortURL := range shortURLs {
+		for _, onInvalidate := range subscribers {
+			onInvalidate(shortURL)
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) SubscribeInvalidations(onInvalidate func(shortURL string)) func() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := c.nextID
+	c.nextID++
+	c.subscribers[id] = onInvalidate
+
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.subscribers, id)
+	}
+}
+
+var (
+	_ URLCache = (*Client)(nil)
+	_ URLCache = (*MemoryCache)(nil)
+)
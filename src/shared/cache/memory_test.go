@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewMemoryCache(3)
+	for _, key := range []string{"a", "b", "c"} {
+		c.AddURL(key, "https://example.com/"+key, time.Hour)
+	}
+
+	// a is used, so b is the least recently used
+	if _, err := c.GetURL("a"); err != nil {
+		t.Fatal(err)
+	}
+	c.AddURL("d", "https://example.com/d", time.Hour)
+
+	if _, err := c.GetURL("b"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("GetURL(b) error = %v, want ErrCacheMiss", err)
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if longURL, err := c.GetURL(key); err != nil || longURL != "https://example.com/"+key {
+			t.Errorf("GetURL(%s) = %q, %v", key, longURL, err)
+		}
+	}
+
+	// replacing an entry keeps the size
+	c.AddURL("c", "https://example.com/new", time.Hour)
+	if longURL, err := c.GetURL("c"); err != nil || longURL != "https://example.com/new" {
+		t.Errorf("GetURL(c) = %q, %v", longURL, err)
+	}
+	if n := c.lru.Len(); n != 3 {
+		t.Errorf("%d entries, want 3", n)
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	c := NewMemoryCache(10)
+	c.AddURL("short", "https://example.com", 20*time.Millisecond)
+	c.AddURL("long", "https://example.com", time.Hour)
+
+	if _, ttl, err := c.GetURLWithTTL("long"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("GetURLWithTTL(long) ttl = %v, %v", ttl, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := c.GetURL("short"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("GetURL() of an expired entry error = %v, want ErrCacheMiss", err)
+	}
+	if n := c.lru.Len(); n != 1 {
+		t.Errorf("%d entries, want the expired entry removed", n)
+	}
+}
+
+// TestMemoryCacheNoExpiry checks that an expiration of 0 keeps an entry, as
+// in Redis, so a url_ttl of 0 caches the links without expiry
+func TestMemoryCacheNoExpiry(t *testing.T) {
+	c := NewMemoryCache(10)
+	c.AddURL("a", "https://example.com", 0)
+
+	longURL, ttl, err := c.GetURLWithTTL("a")
+	if err != nil || longURL != "https://example.com" || ttl != -1 {
+		t.Errorf("GetURLWithTTL() = %q, %v, %v, want a ttl of -1", longURL, ttl, err)
+	}
+
+	// a negative expiration removes the entry
+	c.AddURL("a", "https://example.com", -time.Second)
+	if _, err := c.GetURL("a"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("GetURL() after a negative expiration error = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestMemoryCacheMarkers(t *testing.T) {
+	c := NewMemoryCache(10)
+
+	c.AddMissing("missing", time.Hour)
+	if _, err := c.GetURL("missing"); !errors.Is(err, model.ErrURLNotFound) {
+		t.Errorf("GetURL() of a missing code error = %v, want ErrURLNotFound", err)
+	}
+
+	// a not found result never overwrites a link
+	c.AddURL("link", "https://example.com", time.Hour)
+	c.AddMissing("link", time.Hour)
+	if longURL, err := c.GetURL("link"); err != nil || longURL != "https://example.com" {
+		t.Errorf("GetURL(link) = %q, %v", longURL, err)
+	}
+
+	c.AddGone("link", time.Hour)
+	if _, err := c.GetURL("link"); !errors.Is(err, model.ErrURLGone) {
+		t.Errorf("GetURL() of a gone link error = %v, want ErrURLGone", err)
+	}
+}
+
+func TestMemoryCacheDisabled(t *testing.T) {
+	c := NewMemoryCache(0)
+	c.AddURL("a", "https://example.com", time.Hour)
+	if _, err := c.GetURL("a"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("GetURL() of a disabled cache error = %v, want ErrCacheMiss", err)
+	}
+}
+
+func BenchmarkMemoryCacheAddURL(b *testing.B) {
+	c := NewMemoryCache(1000)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.AddURL(keys[i%len(keys)], "https://example.com", time.Hour)
+	}
+}
@@ -0,0 +1,200 @@
+// Package cassandra is the Cassandra client of the urls and aliases tables,
+// the services add their own tables on top of its session.
+package cassandra
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+// unownedPartition is the urls_by_owner partition of the links created
+// without an owner, Cassandra rejects empty partition keys
+const unownedPartition = "\x00"
+
+// ownerPartition returns the urls_by_owner partition of an owner
+func ownerPartition(owner string) string {
+	if owner == "" {
+		return unownedPartition
+	}
+	return owner
+}
+
+// Client manages the connection and operations to Cassandra
+type Client struct {
+	session *gocql.Session
+	options *Options
+}
+
+// Options holds configuration for Cassandra connection
+type Options struct {
+	Hosts          []string      `mapstructure:"hosts"`
+	Keyspace       string        `mapstructure:"keyspace"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout"`
+}
+
+// NewClient creates a new Cassandra client
+func NewClient(options *Options) (*Client, func(), error) {
+	// Create a cluster config
+	cluster := gocql.NewCluster(options.Hosts...)
+	cluster.Keyspace = options.Keyspace
+	cluster.Consistency = gocql.Quorum
+	cluster.Timeout = options.Timeout
+	cluster.ConnectTimeout = options.ConnectTimeout
+
+	// Create a session
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, nil, errors.New("failed to connect to Cassandra: " + err.Error())
+	}
+
+	log.Println("Connected to Cassandra cluster at", options.Hosts)
+
+	client := &Client{
+		session: session,
+		options: options,
+	}
+
+	return client, func() {
+		session.Close()
+	}, nil
+}
+
+// Session returns the session for the queries of other tables
+func (c *Client) Session() *gocql.Session {
+	return c.session
+}
+
+// SaveURL saves a URL to Cassandra, together with its entry in the links of
+// its owner
+func (c *Client) SaveURL(urlEvent *model.URLEvent) error {
+	batch := c.session.NewBatch(gocql.LoggedBatch)
+	batch.Query("INSERT INTO urls (id, long_url, alias, domain, owner, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		urlEvent.ID, urlEvent.LongURL, urlEvent.Alias, urlEvent.Domain, urlEvent.Owner, urlEvent.CreatedAt, urlEvent.ExpiresAt)
+	batch.Query("INSERT INTO urls_by_owner (owner, id) VALUES (?, ?)", ownerPartition(urlEvent.Owner), urlEvent.ID)
+
+	if err := c.session.ExecuteBatch(batch); err != nil {
+		return errors.New("failed to save URL to Cassandra: " + err.Error())
+	}
+
+	return nil
+}
+
+// ReserveAlias atomically binds an alias to an ID using a lightweight
+// transaction, so two instances can never claim the same alias. Aliases of
+// custom domains are scoped with codec.DomainKey. It returns false if the
+// alias is already taken.
+func (c *Client) ReserveAlias(alias string, id int64, createdAt time.Time) (bool, error) {
+	query := "INSERT INTO aliases (alias, id, created_at) VALUES (?, ?, ?) IF NOT EXISTS"
+	applied, err := c.session.Query(query, alias, id, createdAt).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, errors.New("failed to reserve alias in Cassandra: " + err.Error())
+	}
+
+	return applied, nil
+}
+
+// ReleaseAlias unbinds an alias from an ID with a lightweight transaction,
+// so an alias bound to another ID is kept
+func (c *Client) ReleaseAlias(alias string, id int64) error {
+	query := "DELETE FROM aliases WHERE alias = ? IF id = ?"
+	if _, err := c.session.Query(query, alias, id).MapScanCAS(map[string]interface{}{}); err != nil {
+		return errors.New("failed to release alias in Cassandra: " + err.Error())
+	}
+
+	return nil
+}
+
+// GetURL retrieves a URL from Cassandra by its ID
+func (c *Client) GetURL(id int64) (*model.URLEvent, error) {
+	var urlEvent model.URLEvent
+	query := "SELECT id, long_url, alias, domain, owner, created_at, expires_at, disabled, deleted FROM urls WHERE id = ? LIMIT 1"
+	if err := c.session.Query(query, id).Scan(&urlEvent.ID, &urlEvent.LongURL, &urlEvent.Alias, &urlEvent.Domain,
+		&urlEvent.Owner, &urlEvent.CreatedAt, &urlEvent.ExpiresAt, &urlEvent.Disabled, &urlEvent.Deleted); err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, model.ErrURLNotFound
+		}
+		return nil, errors.New("failed to get URL from Cassandra: " + err.Error())
+	}
+
+	return &urlEvent, nil
+}
+
+// GetAliasID retrieves the ID bound to a custom alias, scoped with
+// codec.DomainKey
+func (c *Client) GetAliasID(alias string) (int64, error) {
+	var id int64
+	query := "SELECT id FROM aliases WHERE alias = ? LIMIT 1"
+	if err := c.session.Query(query, alias).Scan(&id); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, model.ErrURLNotFound
+		}
+		return 0, errors.New("failed to get alias from Cassandra: " + err.Error())
+	}
+
+	return id, nil
+}
+
+// UpdateURL updates the target and the disabled flag of a URL
+func (c *Client) UpdateURL(urlEvent *model.URLEvent) error {
+	query := "UPDATE urls SET long_url = ?, disabled = ? WHERE id = ?"
+	if err := c.session.Query(query, urlEvent.LongURL, urlEvent.Disabled, urlEvent.ID).Exec(); err != nil {
+		return errors.New("failed to update URL in Cassandra: " + err.Error())
+	}
+
+	return nil
+}
+
+// DeleteURL marks a URL as deleted. The row is kept so the redirect service
+// can answer 410 Gone and the ID and alias are never handed out again.
+func (c *Client) DeleteURL(id int64) error {
+	query := "UPDATE urls SET deleted = true WHERE id = ?"
+	if err := c.session.Query(query, id).Exec(); err != nil {
+		return errors.New("failed to delete URL in Cassandra: " + err.Error())
+	}
+
+	return nil
+}
+
+// ListURLs returns up to limit links of an owner with an ID greater than
+// after, in ascending ID order. Deleted links are left out. The links
+// created without an owner are listed for the empty owner.
+func (c *Client) ListURLs(owner string, after int64, limit int) ([]*model.URLEvent, error) {
+	owner = ownerPartition(owner)
+
+	var urlEvents []*model.URLEvent
+	for len(urlEvents) < limit {
+		query := "SELECT id FROM urls_by_owner WHERE owner = ? AND id > ? LIMIT ?"
+		iter := c.session.Query(query, owner, after, limit).Iter()
+
+		var id int64
+		var read int
+		for iter.Scan(&id) {
+			read++
+			after = id
+
+			urlEvent, err := c.GetURL(id)
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			if !urlEvent.Deleted && len(urlEvents) < limit {
+				urlEvents = append(urlEvents, urlEvent)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, errors.New("failed to list URLs from Cassandra: " + err.Error())
+		}
+
+		// the owner has no more links
+		if read < limit {
+			break
+		}
+	}
+
+	return urlEvents, nil
+}
@@ -0,0 +1,146 @@
+// Package codec converts link IDs to the base62 short codes shared by the
+// shorten and redirect services, and keys the codes of a domain.
+package codec
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+const (
+	base62Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	// GeneratedCodeLength is the length of the codes of the first generation,
+	// codes of later generations are longer
+	GeneratedCodeLength = 7
+
+	// maxCodeLength is the length of the code of math.MaxInt64
+	maxCodeLength = 11
+)
+
+var (
+	ErrCodeLength       = errors.New("base62 code must be 7 to 11 characters")
+	ErrInvalidCharacter = errors.New("invalid character in base62 code")
+	ErrNonCanonical     = errors.New("base62 code has a leading zero past the padding")
+	ErrCodeOverflow     = errors.New("base62 code too large for int64")
+)
+
+// base62Digits maps a byte to its base62 digit, -1 for bytes outside the
+// alphabet
+var base62Digits = func() (digits [256]int8) {
+	for i := range digits {
+		digits[i] = -1
+	}
+	for i := 0; i < len(base62Chars); i++ {
+		digits[base62Chars[i]] = int8(i)
+	}
+	return digits
+}()
+
+// GenerationLimit returns the first id past a generation, 62^(6+g). The ids
+// of generation g encode to codes of 6+g characters.
+func GenerationLimit(generation int) int64 {
+	limit := int64(1)
+	for i := 0; i < 6+generation; i++ {
+		limit *= 62
+	}
+	return limit
+}
+
+// AppendBase62 appends the code of an ID to dst, padded with leading zeros to
+// 7 characters. IDs are never negative, a negative ID encodes like 0.
+func AppendBase62(dst []byte, n int64) []byte {
+	var buf [maxCodeLength]byte
+	i := len(buf)
+	for n > 0 {
+		i--
+		buf[i] = base62Chars[n%62]
+		n /= 62
+	}
+	for len(buf)-i < GeneratedCodeLength {
+		i--
+		buf[i] = '0'
+	}
+	return append(dst, buf[i:]...)
+}
+
+// Int64ToBase62 converts an ID to its code of at least 7 characters
+func Int64ToBase62(n int64) string {
+	var buf [maxCodeLength]byte
+	return string(AppendBase62(buf[:0], n))
+}
+
+// Base62ToInt64 converts a code to its ID. Only the canonical code of an ID
+// is accepted: 7 characters, or more without a leading zero, so every ID has
+// exactly one code and a link is cached under a single key.
+func Base62ToInt64(s string) (int64, error) {
+	if len(s) < GeneratedCodeLength || len(s) > maxCodeLength {
+		return 0, ErrCodeLength
+	}
+	if len(s) > GeneratedCodeLength && s[0] == '0' {
+		return 0, ErrNonCanonical
+	}
+
+	var result int64
+	for i := 0; i < len(s); i++ {
+		digit := base62Digits[s[i]]
+		if digit < 0 {
+			return 0, ErrInvalidCharacter
+		}
+		if result > (math.MaxInt64-int64(digit))/62 {
+			return 0, ErrCodeOverflow
+		}
+		result = result*62 + int64(digit)
+	}
+	return result, nil
+}
+
+// IsValidAlias reports whether alias can be used as a custom short code.
+// Aliases are 3-32 characters of [0-9a-zA-Z_-]. Strings that look like a
+// generated 7 character base62 ID are rejected so aliases never shadow them.
+func IsValidAlias(alias string) bool {
+	if len(alias) < 3 || len(alias) > 32 {
+		return false
+	}
+
+	isBase62 := true
+	for i := 0; i < len(alias); i++ {
+		c := alias[i]
+		switch {
+		case base62Digits[c] >= 0:
+		case c == '-' || c == '_':
+			isBase62 = false
+		default:
+			return false
+		}
+	}
+
+	return !(isBase62 && len(alias) == GeneratedCodeLength)
+}
+
+// DomainKey scopes a code to a domain. It keys the aliases table, the cache
+// and the click counters, codes of the default domain are not scoped so the
+// links created before domains keep their keys.
+func DomainKey(domain string, code string) string {
+	if domain == "" {
+		return code
+	}
+	return domain + "/" + code
+}
+
+// LinkKey keys the click counters of a link: the generated code of its ID
+// scoped to its domain, so the clicks of its alias and of its generated code
+// are counted together
+func LinkKey(domain string, id int64) string {
+	return DomainKey(domain, Int64ToBase62(id))
+}
+
+// NormalizeHost lowercases a host and strips its port
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return host
+}
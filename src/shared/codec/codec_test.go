@@ -0,0 +1,159 @@
+package codec
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestBase62RoundTrip(t *testing.T) {
+	ids := []int64{0, 1, 61, 62, 3843, GenerationLimit(1) - 1, GenerationLimit(1), GenerationLimit(2), GenerationLimit(4) - 1, math.MaxInt64 - 1, math.MaxInt64}
+	for _, id := range ids {
+		code := Int64ToBase62(id)
+		got, err := Base62ToInt64(code)
+		if err != nil || got != id {
+			t.Errorf("Base62ToInt64(Int64ToBase62(%d) = %q) = %d, %v", id, code, got, err)
+		}
+	}
+}
+
+func TestInt64ToBase62(t *testing.T) {
+	tests := map[int64]string{
+		0:                  "0000000",
+		1:                  "0000001",
+		61:                 "000000Z",
+		62:                 "0000010",
+		GenerationLimit(1): "10000000",
+		math.MaxInt64:      "aZl8N0y58M7",
+	}
+	for id, want := range tests {
+		if got := Int64ToBase62(id); got != want {
+			t.Errorf("Int64ToBase62(%d) = %q, want %q", id, got, want)
+		}
+	}
+
+	if got := string(AppendBase62([]byte("/short/"), 62)); got != "/short/0000010" {
+		t.Errorf("AppendBase62() = %q", got)
+	}
+}
+
+func TestBase62ToInt64Errors(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+	}{
+		{"", ErrCodeLength},
+		{"000001", ErrCodeLength},
+		{"100000000000", ErrCodeLength},
+		{"00000001", ErrNonCanonical},
+		{"0aZl8N0y58M", ErrNonCanonical},
+		{"aZl8N0y58M8", ErrCodeOverflow},
+		{"ZZZZZZZZZZZ", ErrCodeOverflow},
+		{"000000-", ErrInvalidCharacter},
+		{"my_link", ErrInvalidCharacter},
+		{"abc def", ErrInvalidCharacter},
+		{"abcdéf", ErrInvalidCharacter},
+	}
+	for _, tt := range tests {
+		if got, err := Base62ToInt64(tt.code); !errors.Is(err, tt.want) {
+			t.Errorf("Base62ToInt64(%q) = %d, %v, want %v", tt.code, got, err, tt.want)
+		}
+	}
+}
+
+func TestIsValidAlias(t *testing.T) {
+	tests := map[string]bool{
+		"ab":                     false,
+		"abc":                    true,
+		"spring-sale":            true,
+		"my-link":                true,
+		"my_link":                true,
+		"abcdefg":                false, // shaped like a generated code
+		"abcdefgh":               true,
+		"with space":             false,
+		"slash/":                 false,
+		"a.b.c":                  false,
+		string(make([]byte, 33)): false,
+	}
+	for alias, want := range tests {
+		if got := IsValidAlias(alias); got != want {
+			t.Errorf("IsValidAlias(%q) = %v, want %v", alias, got, want)
+		}
+	}
+}
+
+func TestKeysAndHosts(t *testing.T) {
+	if got := DomainKey("", "abc"); got != "abc" {
+		t.Errorf("DomainKey() = %q", got)
+	}
+	if got := DomainKey("go.example", "abc"); got != "go.example/abc" {
+		t.Errorf("DomainKey() = %q", got)
+	}
+	if got := LinkKey("go.example", 1); got != "go.example/0000001" {
+		t.Errorf("LinkKey() = %q", got)
+	}
+
+	for host, want := range map[string]string{
+		" Go.Example.com:8080 ": "go.example.com",
+		"localhost":             "localhost",
+		"[::1]:80":              "[::1]",
+		"[::1]":                 "[::1]",
+	} {
+		if got := NormalizeHost(host); got != want {
+			t.Errorf("NormalizeHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestBase62ToInt64DoesNotAllocate(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = Base62ToInt64("aZl8N0y58M7")
+		_, _ = Base62ToInt64("00000001")
+	})
+	if allocs != 0 {
+		t.Errorf("Base62ToInt64 allocates %v times", allocs)
+	}
+
+	buf := make([]byte, 0, maxCodeLength)
+	allocs = testing.AllocsPerRun(100, func() {
+		buf = AppendBase62(buf[:0], math.MaxInt64)
+	})
+	if allocs != 0 {
+		t.Errorf("AppendBase62 allocates %v times", allocs)
+	}
+}
+
+func FuzzBase62(f *testing.F) {
+	for _, seed := range []string{"0000000", "0000001", "abcdefg", "10000000", "aZl8N0y58M7", "aZl8N0y58M8", "00000001", "my-link", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		id, err := Base62ToInt64(s)
+		if err != nil {
+			return
+		}
+		if id < 0 {
+			t.Fatalf("Base62ToInt64(%q) = %d", s, id)
+		}
+		// every accepted code is the canonical code of its ID
+		if code := Int64ToBase62(id); code != s {
+			t.Fatalf("Int64ToBase62(Base62ToInt64(%q)) = %q", s, code)
+		}
+	})
+}
+
+func BenchmarkBase62ToInt64(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = Base62ToInt64("aZl8N0y58M7")
+	}
+}
+
+func BenchmarkAppendBase62(b *testing.B) {
+	buf := make([]byte, 0, maxCodeLength)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendBase62(buf[:0], int64(i))
+	}
+}
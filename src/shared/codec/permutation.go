@@ -0,0 +1,71 @@
+package codec
+
+import "math/bits"
+
+// feistelRounds is the number of rounds of the Feistel network, 4 rounds
+// already give a pseudorandom permutation
+const feistelRounds = 6
+
+// FeistelPermutation is a keyed pseudorandom permutation of [0, n). A
+// balanced Feistel network permutes the smallest domain of an even number of
+// bits covering n, values outside [0, n) are cycle-walked back into range.
+// The domain is less than 4n so a walk takes less than 4 steps on average.
+// The id allocation service walks the ids of a segment with it, a single
+// process deployment the ids of the first generation.
+type FeistelPermutation struct {
+	n        uint64
+	halfBits uint
+	halfMask uint64
+	keys     [feistelRounds]uint64
+}
+
+// NewFeistelPermutation creates the permutation of [0, n) keyed by seed
+func NewFeistelPermutation(n int, seed int64) *FeistelPermutation {
+	domainBits := uint(bits.Len64(uint64(n - 1)))
+	halfBits := (domainBits + 1) / 2
+	if halfBits == 0 {
+		halfBits = 1
+	}
+
+	p := &FeistelPermutation{
+		n:        uint64(n),
+		halfBits: halfBits,
+		halfMask: 1<<halfBits - 1,
+	}
+
+	// derive the round keys from the seed
+	state := uint64(seed)
+	for i := range p.keys {
+		state += 0x9e3779b97f4a7c15
+		p.keys[i] = mix64(state)
+	}
+
+	return p
+}
+
+// At returns the value at position i of the permutation
+func (p *FeistelPermutation) At(i int) int {
+	x := uint64(i)
+	for {
+		x = p.encrypt(x)
+		if x < p.n {
+			return int(x)
+		}
+	}
+}
+
+func (p *FeistelPermutation) encrypt(x uint64) uint64 {
+	left := x >> p.halfBits
+	right := x & p.halfMask
+	for _, key := range p.keys {
+		left, right = right, left^(mix64(right^key)&p.halfMask)
+	}
+	return left<<p.halfBits | right
+}
+
+// mix64 is the finalizer of SplitMix64
+func mix64(x uint64) uint64 {
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
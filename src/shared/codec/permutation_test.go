@@ -0,0 +1,58 @@
+package codec
+
+import "testing"
+
+func TestFeistelPermutationIsBijective(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 64, 1000, 4097} {
+		p := NewFeistelPermutation(n, 42)
+
+		seen := make([]bool, n)
+		for i := 0; i < n; i++ {
+			id := p.At(i)
+			if id < 0 || id >= n {
+				t.Fatalf("n=%d: At(%d) = %d out of range", n, i, id)
+			}
+			if seen[id] {
+				t.Fatalf("n=%d: %d handed out twice", n, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestFeistelPermutationIsKeyed(t *testing.T) {
+	const n = 1000
+
+	a := NewFeistelPermutation(n, 1)
+	b := NewFeistelPermutation(n, 1)
+	c := NewFeistelPermutation(n, 2)
+
+	same, sequential := 0, 0
+	for i := 0; i < n; i++ {
+		if a.At(i) != b.At(i) {
+			t.Fatalf("At(%d) differs for the same seed", i)
+		}
+		if a.At(i) == c.At(i) {
+			same++
+		}
+		if a.At(i) == i {
+			sequential++
+		}
+	}
+
+	// a permutation keeps few values in place, whatever the seed
+	if same > n/10 {
+		t.Errorf("%d of %d values equal for different seeds", same, n)
+	}
+	if sequential > n/10 {
+		t.Errorf("%d of %d values are fixed points", sequential, n)
+	}
+}
+
+func BenchmarkFeistelPermutation(b *testing.B) {
+	p := NewFeistelPermutation(1000000, 42)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.At(i % 1000000)
+	}
+}
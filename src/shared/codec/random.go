@@ -0,0 +1,17 @@
+package codec
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// RandomHex returns n random bytes hex encoded, used for API keys and the
+// unique suffixes of instance and consumer names
+func RandomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("failed to generate random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,120 @@
+// Package config loads the config.yaml of a service and binds the options of
+// the clients shared by every service.
+package config
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/cassandra"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/spf13/viper"
+)
+
+// Load reads config.yaml from the working directory, nested keys may be
+// overridden by environment variables with "." replaced by "_". A missing
+// file leaves every option at its default.
+func Load() (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
+	v.AddConfigPath(".")
+
+	v.AutomaticEnv()
+	v.SetEnvPrefix("")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, errors.New("failed to read config file: " + err.Error())
+		}
+		log.Println("Config file not found; using default values")
+	} else {
+		log.Println("Using config file:", v.ConfigFileUsed())
+	}
+
+	return v, nil
+}
+
+// CacheOptions binds the "redis" section, the connection is read from
+// REDIS_SENTINEL_ADDRESS, REDIS_MASTER_NAME and REDIS_PASSWORD
+func CacheOptions(v *viper.Viper) (*cache.Options, error) {
+	var options cache.Options
+	if err := v.UnmarshalKey("redis", &options); err != nil {
+		return nil, errors.New("failed to unmarshal Cache options: " + err.Error())
+	}
+
+	options.SentinelAddress = os.Getenv("REDIS_SENTINEL_ADDRESS")
+	options.MasterName = os.Getenv("REDIS_MASTER_NAME")
+	options.Password = os.Getenv("REDIS_PASSWORD")
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = 5 * time.Second
+	}
+	if options.SetTimeout <= 0 {
+		options.SetTimeout = 5 * time.Second
+	}
+	if options.URLTTL == 0 {
+		options.URLTTL = 24 * time.Hour
+	}
+	if options.NegativeTTL == 0 {
+		options.NegativeTTL = time.Minute
+	}
+	if options.InvalidationChannel == "" {
+		options.InvalidationChannel = "url_invalidations"
+	}
+
+	return &options, nil
+}
+
+// CassandraOptions binds the "cassandra" section, the hosts (comma-separated
+// list) and the keyspace may be overridden with CASSANDRA_HOSTS and
+// CASSANDRA_KEYSPACE
+func CassandraOptions(v *viper.Viper) (*cassandra.Options, error) {
+	var options cassandra.Options
+	if err := v.UnmarshalKey("cassandra", &options); err != nil {
+		return nil, errors.New("failed to unmarshal Cassandra options: " + err.Error())
+	}
+
+	if hosts := os.Getenv("CASSANDRA_HOSTS"); hosts != "" {
+		options.Hosts = strings.Split(hosts, ",")
+	}
+	if len(options.Hosts) == 0 {
+		options.Hosts = []string{"cassandra-1", "cassandra-2", "cassandra-3"}
+	}
+	if keyspace := os.Getenv("CASSANDRA_KEYSPACE"); keyspace != "" {
+		options.Keyspace = keyspace
+	}
+	if options.Keyspace == "" {
+		options.Keyspace = "chopurl_keyspace"
+	}
+
+	return &options, nil
+}
+
+// StoreOptions binds the "store" section, the backend and the Postgres
+// connection string may be overridden with STORE_BACKEND and POSTGRES_DSN
+func StoreOptions(v *viper.Viper) (*store.Options, error) {
+	var options store.Options
+	if err := v.UnmarshalKey("store", &options); err != nil {
+		return nil, errors.New("failed to unmarshal Store options: " + err.Error())
+	}
+
+	if backend := os.Getenv("STORE_BACKEND"); backend != "" {
+		options.Backend = backend
+	}
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn != "" {
+		options.PostgresDSN = dsn
+	}
+	if options.Backend == "" {
+		options.Backend = "cassandra"
+	}
+	if options.SQLitePath == "" {
+		options.SQLitePath = "chopurl.db"
+	}
+
+	return &options, nil
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// ClickEvent is emitted by the redirect service for every successful redirect
+// and aggregated into the click counters by the shorten service
+type ClickEvent struct {
+	Domain    string    `json:"domain,omitempty"` // custom domain of the request, empty for the default domain
+	Code      string    `json:"code"`             // code or alias of the request path
+	Timestamp time.Time `json:"timestamp"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+	Country   string    `json:"country,omitempty"` // ISO 3166-1 alpha-2, set by the edge proxy
+}
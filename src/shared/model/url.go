@@ -0,0 +1,40 @@
+// Package model holds the link model stored in Cassandra and cached in Redis.
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrURLNotFound = errors.New("URL not found")
+	ErrURLGone     = errors.New("URL is no longer available")
+)
+
+type URLEvent struct {
+	ID        int64      `json:"id"`
+	LongURL   string     `json:"long_url"`
+	Alias     string     `json:"alias,omitempty"`
+	Domain    string     `json:"domain,omitempty"` // custom domain of the link, empty for the default domain
+	Owner     string     `json:"owner,omitempty"`  // owner of the API key that created the link
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil if the link never expires
+	Disabled  bool       `json:"disabled"`
+	Deleted   bool       `json:"-"`
+}
+
+// IsExpired reports whether the link has expired at the given time
+func (e *URLEvent) IsExpired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// CacheTTL caps the cache TTL of a link to its remaining lifetime so the cache
+// never outlives the link. A TTL of 0 means no expiry, as in Redis.
+func CacheTTL(now time.Time, expiresAt *time.Time, ttl time.Duration) time.Duration {
+	if expiresAt != nil {
+		if remaining := expiresAt.Sub(now); ttl == 0 || remaining < ttl {
+			return remaining
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+// MemoryStore keeps the links in memory, they are lost on restart. It is
+// meant for tests and single process deployments.
+type MemoryStore struct {
+	lock    sync.RWMutex
+	urls    map[int64]*model.URLEvent
+	aliases map[string]int64
+	idPool  *IDPoolState
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		urls:    make(map[int64]*model.URLEvent),
+		aliases: make(map[string]int64),
+	}
+}
+
+func (s *MemoryStore) SaveURL(urlEvent *model.URLEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// like the Cassandra insert, saving again keeps the flags of the link
+	saved := *urlEvent
+	if existing, ok := s.urls[urlEvent.ID]; ok {
+		saved.Disabled = existing.Disabled
+		saved.Deleted = existing.Deleted
+	} else {
+		saved.Disabled = false
+		saved.Deleted = false
+	}
+	s.urls[urlEvent.ID] = &saved
+
+	return nil
+}
+
+func (s *MemoryStore) GetURL(id int64) (*model.URLEvent, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	urlEvent, ok := s.urls[id]
+	if !ok {
+		return nil, model.ErrURLNotFound
+	}
+
+	copied := *urlEvent
+	return &copied, nil
+}
+
+func (s *MemoryStore) UpdateURL(urlEvent *model.URLEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing, ok := s.urls[urlEvent.ID]; ok {
+		existing.LongURL = urlEvent.LongURL
+		existing.Disabled = urlEvent.Disabled
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteURL(id int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing, ok := s.urls[id]; ok {
+		existing.Deleted = true
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ListURLs(owner string, after int64, limit int) ([]*model.URLEvent, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var urlEvents []*model.URLEvent
+	for _, urlEvent := range s.urls {
+		if urlEvent.Owner == owner && urlEvent.ID > after && !urlEvent.Deleted {
+			copied := *urlEvent
+			urlEvents = append(urlEvents, &copied)
+		}
+	}
+
+	sort.Slice(urlEvents, func(i, j int) bool { return urlEvents[i].ID < urlEvents[j].ID })
+	if len(urlEvents) > limit {
+		urlEvents = urlEvents[:limit]
+	}
+
+	return urlEvents, nil
+}
+
+func (s *MemoryStore) ReserveAlias(alias string, id int64, createdAt time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.aliases[alias]; ok {
+		return false, nil
+	}
+	s.aliases[alias] = id
+
+	return true, nil
+}
+
+func (s *MemoryStore) ReleaseAlias(alias string, id int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if boundID, ok := s.aliases[alias]; ok && boundID == id {
+		delete(s.aliases, alias)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetAliasID(alias string) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	id, ok := s.aliases[alias]
+	if !ok {
+		return 0, model.ErrURLNotFound
+	}
+
+	return id, nil
+}
+
+// MaxID returns the largest ID of a link or an alias, 0 when there is none
+func (s *MemoryStore) MaxID() (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var maxID int64
+	for id := range s.urls {
+		maxID = max(maxID, id)
+	}
+	for _, id := range s.aliases {
+		maxID = max(maxID, id)
+	}
+
+	return maxID, nil
+}
+
+// GetIDPool returns the state of the id pool, nil when it was never saved
+func (s *MemoryStore) GetIDPool() (*IDPoolState, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.idPool == nil {
+		return nil, nil
+	}
+	copied := *s.idPool
+	return &copied, nil
+}
+
+// SaveIDPool saves the state of the id pool
+func (s *MemoryStore) SaveIDPool(state *IDPoolState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	copied := *state
+	s.idPool = &copied
+	return nil
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+// sqlSchema creates the urls and aliases tables and the single row id_pool
+// table, %s is the timestamp type of the dialect
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS urls (
+    id BIGINT PRIMARY KEY,
+    long_url TEXT NOT NULL,
+    alias TEXT NOT NULL,
+    domain TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    created_at %[1]s NOT NULL,
+    expires_at %[1]s,
+    disabled BOOLEAN NOT NULL,
+    deleted BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS urls_owner_id ON urls (owner, id);
+CREATE TABLE IF NOT EXISTS aliases (
+    alias TEXT PRIMARY KEY,
+    id BIGINT NOT NULL,
+    created_at %[1]s NOT NULL
+);
+CREATE TABLE IF NOT EXISTS id_pool (
+    id INTEGER PRIMARY KEY,
+    seed BIGINT NOT NULL,
+    base BIGINT NOT NULL,
+    reserved BIGINT NOT NULL
+);`
+
+const urlColumns = "id, long_url, alias, domain, owner, created_at, expires_at, disabled, deleted"
+
+// SQLStore keeps the links in Postgres or SQLite, the queries are written
+// with ? placeholders and rewritten for Postgres. The services register the
+// "postgres" and "sqlite" drivers with blank imports of github.com/lib/pq
+// and modernc.org/sqlite, so services without links do not link them.
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// NewPostgresStore connects to Postgres and creates the tables if needed
+func NewPostgresStore(dsn string) (*SQLStore, func(), error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, nil, errors.New("failed to open Postgres: " + err.Error())
+	}
+
+	return openSQLStore(db, true, "TIMESTAMPTZ", "Postgres")
+}
+
+// sqlitePragmas wait on a locked database and let the redirects read while
+// a link is written
+const sqlitePragmas = "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+// NewSQLiteStore opens a SQLite database file and creates the tables if
+// needed. The path may be a file: URI with its own parameters. SQLite has a
+// single writer, so the store uses a single connection.
+func NewSQLiteStore(path string) (*SQLStore, func(), error) {
+	db, err := sql.Open("sqlite", sqliteDSN(path))
+	if err != nil {
+		return nil, nil, errors.New("failed to open SQLite: " + err.Error())
+	}
+	db.SetMaxOpenConns(1)
+
+	return openSQLStore(db, false, "TIMESTAMP", "SQLite")
+}
+
+// sqliteDSN appends the pragmas to the query of a path
+func sqliteDSN(path string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + sqlitePragmas
+	}
+	return path + "?" + sqlitePragmas
+}
+
+func openSQLStore(db *sql.DB, postgres bool, timestampType string, name string) (*SQLStore, func(), error) {
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, errors.New("failed to connect to " + name + ": " + err.Error())
+	}
+
+	if _, err := db.Exec(fmt.Sprintf(sqlSchema, timestampType)); err != nil {
+		db.Close()
+		return nil, nil, errors.New("failed to create " + name + " tables: " + err.Error())
+	}
+
+	log.Println("Storing links in", name)
+
+	return &SQLStore{db: db, postgres: postgres}, func() {
+		if err := db.Close(); err != nil {
+			log.Println("failed to close "+name+":", err)
+		}
+	}, nil
+}
+
+// rebind rewrites the ? placeholders of a query to $n for Postgres
+func (s *SQLStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
+
+func (s *SQLStore) SaveURL(urlEvent *model.URLEvent) error {
+	// like the Cassandra insert, saving again keeps the flags of the link
+	query := "INSERT INTO urls (" + urlColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, FALSE, FALSE) " +
+		"ON CONFLICT (id) DO UPDATE SET long_url = excluded.long_url, alias = excluded.alias, domain = excluded.domain, " +
+		"owner = excluded.owner, created_at = excluded.created_at, expires_at = excluded.expires_at"
+	if _, err := s.db.Exec(s.rebind(query), urlEvent.ID, urlEvent.LongURL, urlEvent.Alias, urlEvent.Domain,
+		urlEvent.Owner, urlEvent.CreatedAt.UTC(), utcOrNil(urlEvent.ExpiresAt)); err != nil {
+		return errors.New("failed to save URL: " + err.Error())
+	}
+
+	return nil
+}
+
+func (s *SQLStore) GetURL(id int64) (*model.URLEvent, error) {
+	query := "SELECT " + urlColumns + " FROM urls WHERE id = ?"
+	urlEvent, err := scanURL(s.db.QueryRow(s.rebind(query), id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, model.ErrURLNotFound
+		}
+		return nil, errors.New("failed to get URL: " + err.Error())
+	}
+
+	return urlEvent, nil
+}
+
+func (s *SQLStore) UpdateURL(urlEvent *model.URLEvent) error {
+	query := "UPDATE urls SET long_url = ?, disabled = ? WHERE id = ?"
+	if _, err := s.db.Exec(s.rebind(query), urlEvent.LongURL, urlEvent.Disabled, urlEvent.ID); err != nil {
+		return errors.New("failed to update URL: " + err.Error())
+	}
+
+	return nil
+}
+
+func (s *SQLStore) DeleteURL(id int64) error {
+	query := "UPDATE urls SET deleted = TRUE WHERE id = ?"
+	if _, err := s.db.Exec(s.rebind(query), id); err != nil {
+		return errors.New("failed to delete URL: " + err.Error())
+	}
+
+	return nil
+}
+
+func (s *SQLStore) ListURLs(owner string, after int64, limit int) ([]*model.URLEvent, error) {
+	query := "SELECT " + urlColumns + " FROM urls WHERE owner = ? AND id > ? AND NOT deleted ORDER BY id LIMIT ?"
+	rows, err := s.db.Query(s.rebind(query), owner, after, limit)
+	if err != nil {
+		return nil, errors.New("failed to list URLs: " + err.Error())
+	}
+	defer rows.Close()
+
+	var urlEvents []*model.URLEvent
+	for rows.Next() {
+		urlEvent, err := scanURL(rows)
+		if err != nil {
+			return nil, errors.New("failed to list URLs: " + err.Error())
+		}
+		urlEvents = append(urlEvents, urlEvent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New("failed to list URLs: " + err.Error())
+	}
+
+	return urlEvents, nil
+}
+
+func (s *SQLStore) ReserveAlias(alias string, id int64, createdAt time.Time) (bool, error) {
+	query := "INSERT INTO aliases (alias, id, created_at) VALUES (?, ?, ?) ON CONFLICT (alias) DO NOTHING"
+	result, err := s.db.Exec(s.rebind(query), alias, id, createdAt.UTC())
+	if err != nil {
+		return false, errors.New("failed to reserve alias: " + err.Error())
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("failed to reserve alias: " + err.Error())
+	}
+
+	return inserted == 1, nil
+}
+
+func (s *SQLStore) ReleaseAlias(alias string, id int64) error {
+	query := "DELETE FROM aliases WHERE alias = ? AND id = ?"
+	if _, err := s.db.Exec(s.rebind(query), alias, id); err != nil {
+		return errors.New("failed to release alias: " + err.Error())
+	}
+
+	return nil
+}
+
+func (s *SQLStore) GetAliasID(alias string) (int64, error) {
+	var id int64
+	query := "SELECT id FROM aliases WHERE alias = ?"
+	if err := s.db.QueryRow(s.rebind(query), alias).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, model.ErrURLNotFound
+		}
+		return 0, errors.New("failed to get alias: " + err.Error())
+	}
+
+	return id, nil
+}
+
+// MaxID returns the largest ID of a link or an alias, 0 when there is none.
+// The id pool of a single process deployment hands out the IDs after it.
+func (s *SQLStore) MaxID() (int64, error) {
+	var maxID sql.NullInt64
+	query := "SELECT MAX(id) FROM (SELECT MAX(id) AS id FROM urls UNION ALL SELECT MAX(id) AS id FROM aliases) ids"
+	if err := s.db.QueryRow(query).Scan(&maxID); err != nil {
+		return 0, errors.New("failed to get max ID: " + err.Error())
+	}
+
+	return maxID.Int64, nil
+}
+
+// GetIDPool returns the state of the id pool, nil when it was never saved
+func (s *SQLStore) GetIDPool() (*IDPoolState, error) {
+	var state IDPoolState
+	query := "SELECT seed, base, reserved FROM id_pool WHERE id = 1"
+	if err := s.db.QueryRow(query).Scan(&state.Seed, &state.Base, &state.Reserved); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, errors.New("failed to get id pool: " + err.Error())
+	}
+
+	return &state, nil
+}
+
+// SaveIDPool saves the state of the id pool
+func (s *SQLStore) SaveIDPool(state *IDPoolState) error {
+	query := "INSERT INTO id_pool (id, seed, base, reserved) VALUES (1, ?, ?, ?) " +
+		"ON CONFLICT (id) DO UPDATE SET seed = excluded.seed, base = excluded.base, reserved = excluded.reserved"
+	if _, err := s.db.Exec(s.rebind(query), state.Seed, state.Base, state.Reserved); err != nil {
+		return errors.New("failed to save id pool: " + err.Error())
+	}
+
+	return nil
+}
+
+// scanURL reads a row of urlColumns
+func scanURL(row interface{ Scan(dest ...any) error }) (*model.URLEvent, error) {
+	var urlEvent model.URLEvent
+	var expiresAt sql.NullTime
+	if err := row.Scan(&urlEvent.ID, &urlEvent.LongURL, &urlEvent.Alias, &urlEvent.Domain, &urlEvent.Owner,
+		&urlEvent.CreatedAt, &expiresAt, &urlEvent.Disabled, &urlEvent.Deleted); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		urlEvent.ExpiresAt = &expiresAt.Time
+	}
+
+	return &urlEvent, nil
+}
+
+func utcOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
@@ -0,0 +1,70 @@
+// Package store abstracts the storage of the links, so small deployments can
+// keep them in SQLite, Postgres or memory instead of Cassandra.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cassandra"
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+// LinkStore stores the links and their aliases. Aliases of custom domains
+// are scoped with codec.DomainKey by the caller.
+type LinkStore interface {
+	// SaveURL saves a new link, saving the same link again is harmless
+	SaveURL(urlEvent *model.URLEvent) error
+	// GetURL returns a link by its ID, or model.ErrURLNotFound
+	GetURL(id int64) (*model.URLEvent, error)
+	// UpdateURL updates the target and the disabled flag of a link
+	UpdateURL(urlEvent *model.URLEvent) error
+	// DeleteURL marks a link as deleted, its ID and alias are never reused
+	DeleteURL(id int64) error
+	// ListURLs returns up to limit links of an owner with an ID greater than
+	// after, in ascending ID order. Deleted links are left out. The empty
+	// owner lists the links created without an owner.
+	ListURLs(owner string, after int64, limit int) ([]*model.URLEvent, error)
+	// ReserveAlias binds an alias to an ID, it returns false if the alias is
+	// already taken
+	ReserveAlias(alias string, id int64, createdAt time.Time) (bool, error)
+	// ReleaseAlias unbinds an alias from an ID, an alias bound to another ID
+	// is kept. It undoes the reservation of a link that failed to save.
+	ReleaseAlias(alias string, id int64) error
+	// GetAliasID returns the ID bound to an alias, or model.ErrURLNotFound
+	GetAliasID(alias string) (int64, error)
+}
+
+// IDPoolState is the state of the id pool of a single process deployment,
+// kept with the links so the pool resumes without reusing an ID
+type IDPoolState struct {
+	Seed     int64 // seed of the permutation of the ids
+	Base     int64 // largest ID handed out before the permutation was used
+	Reserved int64 // the ids at offsets below it may have been handed out
+}
+
+type Options struct {
+	Backend     string `mapstructure:"backend"`      // cassandra, postgres, sqlite or memory
+	PostgresDSN string `mapstructure:"postgres_dsn"` // connection string of the postgres backend
+	SQLitePath  string `mapstructure:"sqlite_path"`  // database file of the sqlite backend
+}
+
+// New opens the link store of the configured backend. The cassandra backend
+// uses cassandraClient, which may be nil for the other backends.
+func New(options *Options, cassandraClient *cassandra.Client) (LinkStore, func(), error) {
+	switch options.Backend {
+	case "cassandra":
+		if cassandraClient == nil {
+			return nil, nil, errors.New("cassandra backend without a Cassandra client")
+		}
+		return cassandraClient, func() {}, nil
+	case "postgres":
+		return NewPostgresStore(options.PostgresDSN)
+	case "sqlite":
+		return NewSQLiteStore(options.SQLitePath)
+	case "memory":
+		return NewMemoryStore(), func() {}, nil
+	default:
+		return nil, nil, errors.New("unknown store backend: " + options.Backend)
+	}
+}
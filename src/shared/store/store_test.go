@@ -0,0 +1,283 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+
+	// database/sql drivers of the postgres and sqlite link stores
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// testStores returns the memory and SQLite stores, and the Postgres one when
+// POSTGRES_DSN is set. The Postgres tables are emptied first.
+func testStores(t *testing.T) map[string]LinkStore {
+	stores := map[string]LinkStore{"memory": NewMemoryStore()}
+
+	sqliteStore, cleanup, err := NewSQLiteStore(filepath.Join(t.TempDir(), "chopurl.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	stores["sqlite"] = sqliteStore
+
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn != "" {
+		postgresStore, cleanup, err := NewPostgresStore(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cleanup)
+		if _, err := postgresStore.db.Exec("DELETE FROM urls; DELETE FROM aliases"); err != nil {
+			t.Fatal(err)
+		}
+		stores["postgres"] = postgresStore
+	}
+
+	return stores
+}
+
+func testURL(id int64, owner string) *model.URLEvent {
+	return &model.URLEvent{
+		ID:        id,
+		LongURL:   "https://example.com/" + owner,
+		Owner:     owner,
+		CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestLinkStoreURLs(t *testing.T) {
+	for name, linkStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := linkStore.GetURL(1); !errors.Is(err, model.ErrURLNotFound) {
+				t.Fatalf("GetURL() of a missing link error = %v, want ErrURLNotFound", err)
+			}
+
+			expiresAt := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+			urlEvent := testURL(1, "acme")
+			urlEvent.Alias = "spring-sale"
+			urlEvent.Domain = "go.example"
+			urlEvent.ExpiresAt = &expiresAt
+			if err := linkStore.SaveURL(urlEvent); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := linkStore.GetURL(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.LongURL != urlEvent.LongURL || got.Alias != "spring-sale" || got.Domain != "go.example" || got.Owner != "acme" ||
+				!got.CreatedAt.Equal(urlEvent.CreatedAt) || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expiresAt) {
+				t.Errorf("GetURL() = %+v, want %+v", got, urlEvent)
+			}
+
+			if err := linkStore.UpdateURL(&model.URLEvent{ID: 1, LongURL: "https://example.com/new", Disabled: true}); err != nil {
+				t.Fatal(err)
+			}
+			// saving again, like an outbox retry, keeps the flags
+			if err := linkStore.SaveURL(urlEvent); err != nil {
+				t.Fatal(err)
+			}
+			got, err = linkStore.GetURL(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Disabled {
+				t.Error("saving again cleared the disabled flag")
+			}
+
+			if err := linkStore.DeleteURL(1); err != nil {
+				t.Fatal(err)
+			}
+			got, err = linkStore.GetURL(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Deleted {
+				t.Error("deleted link not marked deleted")
+			}
+		})
+	}
+}
+
+func TestLinkStoreListURLs(t *testing.T) {
+	for name, linkStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, urlEvent := range []*model.URLEvent{
+				testURL(5, "acme"), testURL(2, "acme"), testURL(9, "acme"), testURL(7, "other"),
+				testURL(3, ""), testURL(4, ""),
+			} {
+				if err := linkStore.SaveURL(urlEvent); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := linkStore.DeleteURL(9); err != nil {
+				t.Fatal(err)
+			}
+
+			ids := func(owner string, after int64, limit int) []int64 {
+				urlEvents, err := linkStore.ListURLs(owner, after, limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := []int64{}
+				for _, urlEvent := range urlEvents {
+					ids = append(ids, urlEvent.ID)
+				}
+				return ids
+			}
+
+			// in ID order, without deleted links, paged with after
+			for _, tt := range []struct {
+				owner string
+				after int64
+				limit int
+				want  []int64
+			}{
+				{owner: "acme", limit: 10, want: []int64{2, 5}},
+				{owner: "acme", limit: 1, want: []int64{2}},
+				{owner: "acme", after: 2, limit: 10, want: []int64{5}},
+				{owner: "acme", after: 5, limit: 10, want: []int64{}},
+				{owner: "other", limit: 10, want: []int64{7}},
+				{owner: "nobody", limit: 10, want: []int64{}},
+				// the empty owner lists the links created without an owner
+				{owner: "", limit: 10, want: []int64{3, 4}},
+			} {
+				if got := ids(tt.owner, tt.after, tt.limit); !equalIDs(got, tt.want) {
+					t.Errorf("ListURLs(%q, %d, %d) = %v, want %v", tt.owner, tt.after, tt.limit, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkStoreAliases(t *testing.T) {
+	for name, linkStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := linkStore.GetAliasID("spring-sale"); !errors.Is(err, model.ErrURLNotFound) {
+				t.Fatalf("GetAliasID() of a missing alias error = %v, want ErrURLNotFound", err)
+			}
+
+			reserved, err := linkStore.ReserveAlias("spring-sale", 42, time.Now())
+			if err != nil || !reserved {
+				t.Fatalf("ReserveAlias() = %v, %v", reserved, err)
+			}
+			// an alias is bound once
+			reserved, err = linkStore.ReserveAlias("spring-sale", 43, time.Now())
+			if err != nil || reserved {
+				t.Fatalf("ReserveAlias() of a taken alias = %v, %v", reserved, err)
+			}
+			// aliases of other domains are independent
+			reserved, err = linkStore.ReserveAlias("go.example/spring-sale", 44, time.Now())
+			if err != nil || !reserved {
+				t.Fatalf("ReserveAlias() on another domain = %v, %v", reserved, err)
+			}
+
+			if id, err := linkStore.GetAliasID("spring-sale"); err != nil || id != 42 {
+				t.Errorf("GetAliasID() = %d, %v, want 42", id, err)
+			}
+			if id, err := linkStore.GetAliasID("go.example/spring-sale"); err != nil || id != 44 {
+				t.Errorf("GetAliasID() = %d, %v, want 44", id, err)
+			}
+
+			// an alias is only released by the ID it is bound to
+			if err := linkStore.ReleaseAlias("spring-sale", 43); err != nil {
+				t.Fatal(err)
+			}
+			if id, err := linkStore.GetAliasID("spring-sale"); err != nil || id != 42 {
+				t.Errorf("GetAliasID() after a release by another ID = %d, %v, want 42", id, err)
+			}
+			if err := linkStore.ReleaseAlias("spring-sale", 42); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := linkStore.GetAliasID("spring-sale"); !errors.Is(err, model.ErrURLNotFound) {
+				t.Errorf("GetAliasID() of a released alias error = %v, want ErrURLNotFound", err)
+			}
+			reserved, err = linkStore.ReserveAlias("spring-sale", 45, time.Now())
+			if err != nil || !reserved {
+				t.Errorf("ReserveAlias() of a released alias = %v, %v", reserved, err)
+			}
+		})
+	}
+}
+
+func TestIDPool(t *testing.T) {
+	for name, linkStore := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			idStore := linkStore.(interface {
+				MaxID() (int64, error)
+				GetIDPool() (*IDPoolState, error)
+				SaveIDPool(state *IDPoolState) error
+			})
+
+			if maxID, err := idStore.MaxID(); err != nil || maxID != 0 {
+				t.Fatalf("MaxID() of an empty store = %d, %v", maxID, err)
+			}
+			if state, err := idStore.GetIDPool(); err != nil || state != nil {
+				t.Fatalf("GetIDPool() of an empty store = %+v, %v, want nil", state, err)
+			}
+
+			if err := linkStore.SaveURL(testURL(7, "")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := linkStore.ReserveAlias("long-code", 12, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			// the IDs of reserved aliases count, they are never handed out again
+			if maxID, err := idStore.MaxID(); err != nil || maxID != 12 {
+				t.Errorf("MaxID() = %d, %v, want 12", maxID, err)
+			}
+
+			for _, want := range []IDPoolState{
+				{Seed: 42, Base: 12, Reserved: 1000},
+				{Seed: 42, Base: 12, Reserved: 2000},
+			} {
+				if err := idStore.SaveIDPool(&want); err != nil {
+					t.Fatal(err)
+				}
+				state, err := idStore.GetIDPool()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if state == nil || *state != want {
+					t.Errorf("GetIDPool() = %+v, want %+v", state, want)
+				}
+			}
+		})
+	}
+}
+
+// TestSQLiteDSN checks that the pragmas are applied to a path with its own
+// parameters
+func TestSQLiteDSN(t *testing.T) {
+	path := "file:" + filepath.Join(t.TempDir(), "chopurl.db") + "?mode=rwc"
+	sqliteStore, cleanup, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	var journalMode string
+	if err := sqliteStore.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatal(err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("journal mode = %q, want wal", journalMode)
+	}
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,155 +1,212 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
-
-	"github.com/spf13/viper"
+	"syscall"
+	"time"
+
+	"github.com/qninh/chopurl/url-redirect-service/redirect"
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/cassandra"
+	"github.com/qninhdt/chopurl/src/shared/config"
+	"github.com/qninhdt/chopurl/src/shared/store"
 	"github.com/valyala/fasthttp"
+
+	// database/sql drivers of the postgres and sqlite link stores
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
 	// load configuration
-	v := viper.New()
-	v.SetConfigName("config")
-	v.SetConfigType("yaml")
-	v.AddConfigPath(".")
+	v, err := config.Load()
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
 
-	if err := v.ReadInConfig(); err != nil {
-		log.Fatal("Error reading config file: ", err)
+	// bind to cache.Options
+	cacheOptions, err := config.CacheOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Cache options: ", err)
 	}
 
-	v.AutomaticEnv()
-	v.SetEnvPrefix("")
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	// bind to cassandra.Options
+	cassandraOptions, err := config.CassandraOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Cassandra options: ", err)
+	}
 
-	// bind to CacheOptions
-	var cacheOptions CacheOptions
-	if err := v.UnmarshalKey("redis", &cacheOptions); err != nil {
-		log.Fatal("Error unmarshalling Cache options: ", err)
+	// bind to store.Options
+	storeOptions, err := config.StoreOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Store options: ", err)
 	}
 
-	cacheOptions.SentinelAddress = os.Getenv("REDIS_SENTINEL_ADDRESS")
-	cacheOptions.MasterName = os.Getenv("REDIS_MASTER_NAME")
-	cacheOptions.Password = os.Getenv("REDIS_PASSWORD")
+	// bind to redirect.LocalCacheOptions
+	var localCacheOptions redirect.LocalCacheOptions
+	if err := v.UnmarshalKey("local_cache", &localCacheOptions); err != nil {
+		log.Fatal("Error unmarshalling Local Cache options: ", err)
+	}
 
-	// bind to CassandraOptions
-	var cassandraOptions CassandraOptions
-	if err := v.UnmarshalKey("cassandra", &cassandraOptions); err != nil {
-		log.Fatal("Error unmarshalling Cassandra options: ", err)
+	// bind to redirect.ClickOptions
+	var clickOptions redirect.ClickOptions
+	if err := v.UnmarshalKey("kafka", &clickOptions); err != nil {
+		log.Fatal("Error unmarshalling Kafka options: ", err)
 	}
 
-	// Get Cassandra hosts from environment variable (comma-separated list)
-	cassandraHostsEnv := os.Getenv("CASSANDRA_HOSTS")
-	if cassandraHostsEnv != "" {
-		cassandraOptions.Hosts = strings.Split(cassandraHostsEnv, ",")
-	} else {
-		// Default hosts if not specified in environment
-		cassandraOptions.Hosts = []string{"localhost"} // Changed to localhost for local development
+	// Get Kafka brokers from environment variable (comma-separated list)
+	if kafkaBrokersEnv := os.Getenv("KAFKA_BROKERS"); kafkaBrokersEnv != "" {
+		clickOptions.Brokers = strings.Split(kafkaBrokersEnv, ",")
+	}
+	if salt := os.Getenv("CLICK_IP_HASH_SALT"); salt != "" {
+		clickOptions.IPHashSalt = salt
+	}
+	if clickOptions.Topic == "" {
+		clickOptions.Topic = "clicks"
+	}
+	if clickOptions.BufferSize <= 0 {
+		clickOptions.BufferSize = 10000
 	}
-	cassandraOptions.Keyspace = os.Getenv("CASSANDRA_KEYSPACE")
-	if cassandraOptions.Keyspace == "" {
-		cassandraOptions.Keyspace = "chopurl_keyspace"
+	if clickOptions.BatchSize <= 0 {
+		clickOptions.BatchSize = 500
+	}
+	if clickOptions.BatchTimeout <= 0 {
+		clickOptions.BatchTimeout = time.Second
+	}
+	if clickOptions.WriteTimeout <= 0 {
+		clickOptions.WriteTimeout = 5 * time.Second
 	}
 
-	// init cache client
-	cacheClient, cleanup, err := NewCacheClient(&cacheOptions)
-	if err != nil {
-		log.Fatal("Error initializing Cache Client: ", err)
+	// bind to redirect.SegmentFilterOptions
+	var segmentFilterOptions redirect.SegmentFilterOptions
+	if err := v.UnmarshalKey("segment_filter", &segmentFilterOptions); err != nil {
+		log.Fatal("Error unmarshalling Segment Filter options: ", err)
 	}
-	defer cleanup()
 
-	// init cassandra client
-	cassandraClient, cleanup, err := NewCassandraClient(&cassandraOptions)
-	if err != nil {
-		log.Fatal("Error initializing Cassandra Client: ", err)
+	// bind to redirect.DomainOptions
+	var domainOptions redirect.DomainOptions
+	if err := v.UnmarshalKey("domains", &domainOptions); err != nil {
+		log.Fatal("Error unmarshalling Domain options: ", err)
+	}
+
+	// bind to redirect.EtcdOptions
+	var etcdOptions redirect.EtcdOptions
+	if err := v.UnmarshalKey("etcd", &etcdOptions); err != nil {
+		log.Fatal("Error unmarshalling Etcd options: ", err)
 	}
-	defer cleanup()
 
-	// Add CORS and rate limiting middleware
-	middleware := func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
-		return func(ctx *fasthttp.RequestCtx) {
-			// Add CORS headers
-			// ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
-			// ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-			// ctx.Response.Header.Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+	etcdOptions.Address = os.Getenv("ETCD_ADDRESS")
 
-			// Call the original handler
-			h(ctx)
-		}
+	// bind to redirect.ServerOptions
+	var serverOptions redirect.ServerOptions
+	if err := v.UnmarshalKey("server", &serverOptions); err != nil {
+		log.Fatal("Error unmarshalling Server options: ", err)
 	}
 
-	// redirect handler
-	redirectHandler := func(ctx *fasthttp.RequestCtx) {
-		if !ctx.IsGet() {
-			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
-			return
-		}
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		serverOptions.Port = envPort
+	}
+	if serverOptions.Port == "" {
+		serverOptions.Port = "8080"
+	}
+	if serverOptions.ShutdownTimeout <= 0 {
+		serverOptions.ShutdownTimeout = 10 * time.Second
+	}
 
-		// Get the short URL ID from the path
-		path := string(ctx.Path())
-		parts := strings.Split(path, "/")
-		if len(parts) != 3 || parts[1] != "short" {
-			ctx.Error("Invalid URL format. Expected /short/:id", fasthttp.StatusBadRequest)
-			return
-		}
+	// init cache client
+	cacheClient, cleanup, err := cache.NewClient(cacheOptions)
+	if err != nil {
+		log.Fatal("Error initializing Cache Client: ", err)
+	}
+	defer cleanup()
 
-		shortURL := parts[2]
-		if shortURL == "" {
-			ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
-			return
+	// init cassandra client, it is only needed by the cassandra backend
+	var cassandraClient *cassandra.Client
+	if storeOptions.Backend == "cassandra" {
+		cassandraClient, cleanup, err = cassandra.NewClient(cassandraOptions)
+		if err != nil {
+			log.Fatal("Error initializing Cassandra Client: ", err)
 		}
+		defer cleanup()
+	}
 
-		// Try to get the URL from cache first
-		longURL, err := cacheClient.GetURL(shortURL)
+	// init link store
+	linkStore, cleanup, err := store.New(storeOptions, cassandraClient)
+	if err != nil {
+		log.Fatal("Error initializing Link Store: ", err)
+	}
+	defer cleanup()
+
+	// init segment filter
+	var segmentFilter *redirect.SegmentFilter
+	if segmentFilterOptions.Enabled {
+		segmentFilter, cleanup, err = redirect.NewSegmentFilter(&segmentFilterOptions, &etcdOptions)
 		if err != nil {
-			// If not in cache, try to get from Cassandra
-			id, err := Base62ToInt64(shortURL)
-			if err != nil {
-				ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
-				return
-			}
-
-			urlEvent, err := cassandraClient.GetURL(id)
-			if err != nil {
-				ctx.Error("URL not found", fasthttp.StatusNotFound)
-				return
-			}
-
-			longURL = urlEvent.LongURL
+			log.Fatal("Error initializing Segment Filter: ", err)
 		}
-
-		// Redirect to the long URL
-		ctx.Redirect(longURL, fasthttp.StatusMovedPermanently)
+		defer cleanup()
 	}
 
-	// health check
-	healthHandler := func(ctx *fasthttp.RequestCtx) {
-		ctx.SetStatusCode(fasthttp.StatusOK)
-		ctx.Write([]byte("OK"))
+	// init local cache, entries are dropped when a link is updated or deleted
+	var localCache *redirect.LocalCache
+	if localCacheOptions.Size > 0 {
+		localCache = redirect.NewLocalCache(&localCacheOptions)
+		cleanup := cacheClient.SubscribeInvalidations(localCache.Delete)
+		defer cleanup()
 	}
 
-	// Set up the handler
-	router := func(ctx *fasthttp.RequestCtx) {
-		path := string(ctx.Path())
-		switch {
-		case path == "/health":
-			healthHandler(ctx)
-		case strings.HasPrefix(path, "/short/"):
-			redirectHandler(ctx)
-		default:
-			ctx.Error("Not found", fasthttp.StatusNotFound)
+	// init click producer, clicks are not recorded without kafka brokers
+	var clickProducer *redirect.ClickProducer
+	if len(clickOptions.Brokers) > 0 {
+		clickProducer, cleanup, err = redirect.NewClickProducer(&clickOptions)
+		if err != nil {
+			log.Fatal("Error initializing Click Producer: ", err)
 		}
+		defer cleanup()
+	} else {
+		log.Println("No kafka brokers configured; clicks are not recorded")
 	}
 
-	var port string = "8080"
-	if envPort := os.Getenv("PORT"); envPort != "" {
-		port = envPort
+	// init domains, the code of a request is resolved in the domain of its host
+	domains := redirect.NewDomains(&domainOptions)
+
+	// init resolver, it backfills the cache on misses
+	resolver := redirect.NewResolver(localCache, cacheClient, linkStore, segmentFilter, cacheOptions)
+
+	// the redirects and the health check
+	handler := redirect.NewHandler(&redirect.Dependencies{
+		Resolver:      resolver,
+		Domains:       domains,
+		ClickProducer: clickProducer,
+		ClickOptions:  &clickOptions,
+	})
+
+	server := &fasthttp.Server{
+		Handler: handler,
 	}
 
-	log.Println("Starting server on port", port)
-	if err := fasthttp.ListenAndServe(":"+port, middleware(router)); err != nil {
-		log.Fatal("Error starting server: ", err)
+	go func() {
+		log.Println("Starting server on port", serverOptions.Port)
+		if err := server.ListenAndServe(":" + serverOptions.Port); err != nil {
+			log.Fatal("Error starting server: ", err)
+		}
+	}()
+
+	// wait for a termination signal
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	// stop accepting connections and drain in-flight requests before the
+	// deferred cleanups flush the buffered clicks and close the clients
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverOptions.ShutdownTimeout)
+	defer cancel()
+	if err := server.ShutdownWithContext(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
 	}
 }
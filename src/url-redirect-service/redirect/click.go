@@ -0,0 +1,142 @@
+package redirect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/segmentio/kafka-go"
+)
+
+// ClickProducer publishes click events to Kafka in the background. Emit never
+// blocks the redirect path, events are dropped when the buffer is full.
+type ClickProducer struct {
+	writer  *kafka.Writer
+	events  chan *model.ClickEvent
+	done    chan struct{}
+	dropped atomic.Int64
+	options *ClickOptions
+}
+
+type ClickOptions struct {
+	Brokers       []string      `mapstructure:"brokers"`        // kafka brokers, clicks are not recorded when empty
+	Topic         string        `mapstructure:"topic"`          // topic of the click events
+	BufferSize    int           `mapstructure:"buffer_size"`    // number of events buffered before dropping
+	BatchSize     int           `mapstructure:"batch_size"`     // maximum number of events per write
+	BatchTimeout  time.Duration `mapstructure:"batch_timeout"`  // maximum delay before a partial batch is written
+	WriteTimeout  time.Duration `mapstructure:"write_timeout"`  // timeout of a batch write
+	IPHashSalt    string        `mapstructure:"ip_hash_salt"`   // salt of the client IP hash
+	CountryHeader string        `mapstructure:"country_header"` // request header carrying the client country
+}
+
+func NewClickProducer(options *ClickOptions) (*ClickProducer, func(), error) {
+	if len(options.Brokers) == 0 {
+		return nil, nil, errors.New("no kafka brokers configured")
+	}
+
+	// events of the same code go to the same partition, batching is done by
+	// the producer so the writer flushes as soon as a batch is handed over
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(options.Brokers...),
+		Topic:        options.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    options.BatchSize,
+		BatchTimeout: time.Millisecond,
+		WriteTimeout: options.WriteTimeout,
+		RequiredAcks: kafka.RequireOne,
+	}
+
+	log.Println("Publishing click events to kafka at", options.Brokers)
+
+	producer := &ClickProducer{
+		writer:  writer,
+		events:  make(chan *model.ClickEvent, options.BufferSize),
+		done:    make(chan struct{}),
+		options: options,
+	}
+
+	go producer.run()
+
+	return producer, func() {
+		// flush the buffered events before closing the writer
+		close(producer.events)
+		<-producer.done
+		if err := writer.Close(); err != nil {
+			log.Println("failed to close kafka writer:", err)
+		}
+	}, nil
+}
+
+// Emit queues a click event without blocking
+func (p *ClickProducer) Emit(event *model.ClickEvent) {
+	select {
+	case p.events <- event:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// HashIP hashes a client IP with the configured salt so clicks can be told
+// apart without storing the address
+func (p *ClickProducer) HashIP(ip string) string {
+	sum := sha256.Sum256([]byte(p.options.IPHashSalt + ip))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (p *ClickProducer) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.options.BatchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]kafka.Message, 0, p.options.BatchSize)
+	for {
+		select {
+		case event, ok := <-p.events:
+			if !ok {
+				p.write(batch)
+				return
+			}
+
+			value, err := json.Marshal(event)
+			if err != nil {
+				log.Println("failed to encode click event:", err)
+				continue
+			}
+
+			batch = append(batch, kafka.Message{Key: []byte(codec.DomainKey(event.Domain, event.Code)), Value: value})
+			if len(batch) >= p.options.BatchSize {
+				p.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.write(batch)
+			batch = batch[:0]
+
+			if dropped := p.dropped.Swap(0); dropped > 0 {
+				log.Println("Dropped click events, buffer full:", dropped)
+			}
+		}
+	}
+}
+
+// write sends a batch to Kafka, failed batches are logged and discarded
+func (p *ClickProducer) write(batch []kafka.Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.options.WriteTimeout)
+	defer cancel()
+
+	if err := p.writer.WriteMessages(ctx, batch...); err != nil {
+		log.Printf("Error writing %d click events: %v", len(batch), err)
+	}
+}
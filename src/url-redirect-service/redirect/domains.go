@@ -0,0 +1,32 @@
+package redirect
+
+import "github.com/qninhdt/chopurl/src/shared/codec"
+
+type DomainOptions struct {
+	Hosts []string `mapstructure:"hosts"` // hosts of the custom domains, any other host resolves codes of the default domain
+}
+
+// Domains maps the Host header of a request to the domain its code is
+// resolved in. Every custom domain is an independent namespace of codes, the
+// default domain is the empty one.
+type Domains struct {
+	hosts map[string]struct{}
+}
+
+func NewDomains(options *DomainOptions) *Domains {
+	hosts := make(map[string]struct{}, len(options.Hosts))
+	for _, host := range options.Hosts {
+		hosts[codec.NormalizeHost(host)] = struct{}{}
+	}
+
+	return &Domains{hosts: hosts}
+}
+
+// RequestDomain returns the domain of a request Host header
+func (d *Domains) RequestDomain(host string) string {
+	host = codec.NormalizeHost(host)
+	if _, ok := d.hosts[host]; ok {
+		return host
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+// Package redirect serves the redirects of the short links, it is run by the
+// url redirect service and by the all-in-one chopurl binary.
+package redirect
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/valyala/fasthttp"
+)
+
+type ServerOptions struct {
+	Port            string        `mapstructure:"port"`             // port the server listens on
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"` // maximum time to drain in-flight requests on shutdown
+}
+
+// Dependencies are the clients and options the handler is built from
+type Dependencies struct {
+	Resolver      *Resolver
+	Domains       *Domains
+	ClickProducer *ClickProducer // nil when clicks are not recorded
+	ClickOptions  *ClickOptions
+}
+
+// NewHandler returns the handler of the /short/:id redirects and /health
+func NewHandler(deps *Dependencies) fasthttp.RequestHandler {
+	resolver := deps.Resolver
+	domains := deps.Domains
+	clickProducer := deps.ClickProducer
+	clickOptions := deps.ClickOptions
+
+	// Add CORS and rate limiting middleware
+	middleware := func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			// Add CORS headers
+			// ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+			// ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			// ctx.Response.Header.Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+
+			// Call the original handler
+			h(ctx)
+		}
+	}
+
+	// redirect handler
+	redirectHandler := func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsGet() {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		// Get the short URL ID from the path
+		path := string(ctx.Path())
+		parts := strings.Split(path, "/")
+		if len(parts) != 3 || parts[1] != "short" {
+			ctx.Error("Invalid URL format. Expected /short/:id", fasthttp.StatusBadRequest)
+			return
+		}
+
+		shortURL := parts[2]
+		if shortURL == "" {
+			ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
+			return
+		}
+
+		domain := domains.RequestDomain(string(ctx.Host()))
+		longURL, err := resolver.Resolve(domain, shortURL)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidCode):
+				ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
+			case errors.Is(err, ErrURLExpired):
+				ctx.Error("URL has expired", fasthttp.StatusGone)
+			case errors.Is(err, model.ErrURLGone):
+				ctx.Error("URL is no longer available", fasthttp.StatusGone)
+			default:
+				ctx.Error("URL not found", fasthttp.StatusNotFound)
+			}
+			return
+		}
+
+		// record the click in the background
+		if clickProducer != nil {
+			clientIP := string(ctx.Request.Header.Peek("X-Real-IP"))
+			if clientIP == "" {
+				clientIP = ctx.RemoteIP().String()
+			}
+
+			// the consumer counts the clicks of a link under its ID, whichever
+			// code was used
+			clickProducer.Emit(&model.ClickEvent{
+				Domain:    domain,
+				Code:      shortURL,
+				Timestamp: time.Now(),
+				Referrer:  string(ctx.Referer()),
+				UserAgent: string(ctx.UserAgent()),
+				IPHash:    clickProducer.HashIP(clientIP),
+				Country:   string(ctx.Request.Header.Peek(clickOptions.CountryHeader)),
+			})
+		}
+
+		// Redirect to the long URL, a permanent redirect would be cached by
+		// browsers and their clicks would never reach us
+		ctx.Redirect(longURL, fasthttp.StatusFound)
+	}
+
+	// health check
+	healthHandler := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.Write([]byte("OK"))
+	}
+
+	// Set up the handler
+	router := func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		switch {
+		case path == "/health":
+			healthHandler(ctx)
+		case strings.HasPrefix(path, "/short/"):
+			redirectHandler(ctx)
+		default:
+			ctx.Error("Not found", fasthttp.StatusNotFound)
+		}
+	}
+
+	return middleware(router)
+}
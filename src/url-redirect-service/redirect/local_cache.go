@@ -0,0 +1,54 @@
+package redirect
+
+import (
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+)
+
+// LocalCache is a bounded in-process LRU cache of short code to long URL
+// mappings, it sits in front of Redis for the hottest links. Entries expire
+// after a fixed TTL so a missed invalidation only serves a stale target for
+// a short while.
+type LocalCache struct {
+	lru     *cache.LRU
+	options *LocalCacheOptions
+}
+
+type LocalCacheOptions struct {
+	Size int           `mapstructure:"size"` // maximum number of entries, 0 disables the local cache
+	TTL  time.Duration `mapstructure:"ttl"`  // lifetime of an entry
+}
+
+func NewLocalCache(options *LocalCacheOptions) *LocalCache {
+	return &LocalCache{
+		lru:     cache.NewLRU(options.Size),
+		options: options,
+	}
+}
+
+// Get returns the cached value of a key if it is present and not expired
+func (c *LocalCache) Get(key string) (string, bool) {
+	value, _, ok := c.lru.Get(key)
+	return value, ok
+}
+
+// Set adds or replaces a value, the entry lives for the configured TTL or
+// maxTTL, whichever is shorter. A maxTTL of 0 leaves the configured TTL, like
+// a Redis entry without expiry, and a negative one stores nothing.
+func (c *LocalCache) Set(key string, value string, maxTTL time.Duration) {
+	ttl := c.options.TTL
+	if maxTTL != 0 && maxTTL < ttl {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.lru.Set(key, value, ttl)
+}
+
+// Delete removes a key from the cache
+func (c *LocalCache) Delete(key string) {
+	c.lru.Delete(key)
+}
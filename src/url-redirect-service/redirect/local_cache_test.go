@@ -0,0 +1,79 @@
+package redirect
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLocalCache(&LocalCacheOptions{Size: 2, TTL: time.Hour})
+
+	c.Set("a", "A", time.Hour)
+	c.Set("b", "B", time.Hour)
+	// a becomes the most recently used entry
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	c.Set("c", "C", time.Hour)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestLocalCacheSizeIsBounded(t *testing.T) {
+	c := NewLocalCache(&LocalCacheOptions{Size: 10, TTL: time.Hour})
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), "v", time.Hour)
+	}
+
+	if n := c.lru.Len(); n != 10 {
+		t.Fatalf("cache holds %d entries, want 10", n)
+	}
+}
+
+func TestLocalCacheTTL(t *testing.T) {
+	c := NewLocalCache(&LocalCacheOptions{Size: 10, TTL: time.Hour})
+
+	// maxTTL caps the configured TTL
+	c.Set("a", "A", 20*time.Millisecond)
+	if v, ok := c.Get("a"); !ok || v != "A" {
+		t.Fatalf("Get(a) = %q, %v", v, ok)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("a outlived its maxTTL")
+	}
+
+	// a maxTTL of 0 is a cache entry without expiry, the configured TTL applies
+	c.Set("b", "B", 0)
+	if _, ok := c.Get("b"); !ok {
+		t.Error("b not stored without a maxTTL")
+	}
+
+	// entries without a lifetime left are not stored
+	c.Set("c", "C", -time.Millisecond)
+	if _, ok := c.Get("c"); ok {
+		t.Error("c stored with no lifetime left")
+	}
+}
+
+func TestLocalCacheDelete(t *testing.T) {
+	c := NewLocalCache(&LocalCacheOptions{Size: 10, TTL: time.Hour})
+	c.Set("a", "A", time.Hour)
+	c.Set("a", "A2", time.Hour)
+	if v, _ := c.Get("a"); v != "A2" {
+		t.Fatalf("Get(a) = %q, want A2", v)
+	}
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("a not deleted")
+	}
+}
@@ -0,0 +1,190 @@
+package redirect
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid short code")
+	ErrURLExpired  = errors.New("URL has expired")
+)
+
+// Resolver resolves short codes to long URLs. Every custom domain is an
+// independent namespace of codes, the cache is keyed by the code scoped to
+// its domain with codec.DomainKey. Codes missing from the cache
+// are read from the link store and written back to the cache, concurrent misses
+// for the same code are coalesced into a single store query. Codes that
+// do not exist are cached as well so scanners cannot hammer the store.
+type Resolver struct {
+	localCache    *LocalCache // nil if the local cache is disabled
+	cacheClient   cache.URLCache
+	linkStore     store.LinkStore
+	segmentFilter *SegmentFilter // nil if the segment filter is disabled
+	options       *cache.Options
+	group         singleflight.Group
+}
+
+// NewResolver creates a new resolver on top of the cache and the link
+// store, localCache and segmentFilter are optional
+func NewResolver(localCache *LocalCache, cacheClient cache.URLCache, linkStore store.LinkStore, segmentFilter *SegmentFilter, options *cache.Options) *Resolver {
+	return &Resolver{
+		localCache:    localCache,
+		cacheClient:   cacheClient,
+		linkStore:     linkStore,
+		segmentFilter: segmentFilter,
+		options:       options,
+	}
+}
+
+// Resolve returns the long URL of a short code or alias on a domain
+func (r *Resolver) Resolve(domain string, shortURL string) (string, error) {
+	// codes that can be neither an alias nor a canonical base62 code are
+	// rejected before touching the caches
+	if !codec.IsValidAlias(shortURL) {
+		if _, err := codec.Base62ToInt64(shortURL); err != nil {
+			return "", ErrInvalidCode
+		}
+	}
+
+	key := codec.DomainKey(domain, shortURL)
+
+	// Hot links are served from memory
+	if r.localCache != nil {
+		if longURL, ok := r.localCache.Get(key); ok {
+			return longURL, nil
+		}
+	}
+
+	// Try to get the URL from cache first
+	longURL, ttl, err := r.cacheClient.GetURLWithTTL(key)
+	if err == nil {
+		// the Redis entry is capped to the link lifetime, the local copy
+		// must not outlive it either
+		if ttl < 0 {
+			ttl = r.options.URLTTL
+		}
+		r.addLocal(key, longURL, ttl)
+		return longURL, nil
+	}
+	if errors.Is(err, model.ErrURLNotFound) || errors.Is(err, model.ErrURLGone) {
+		return "", err
+	}
+
+	// If not in cache, load it from the link store, only one load per code is in
+	// flight at any time on this instance
+	v, err, _ := r.group.Do(key, func() (interface{}, error) {
+		return r.load(domain, shortURL)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return v.(string), nil
+}
+
+// load reads a short code of a domain from the link store and populates the cache
+func (r *Resolver) load(domain string, shortURL string) (string, error) {
+	key := codec.DomainKey(domain, shortURL)
+
+	id, err := r.resolveID(domain, shortURL)
+	if err != nil {
+		if errors.Is(err, model.ErrURLNotFound) {
+			r.addMissing(key)
+		}
+		return "", err
+	}
+
+	// codes from segments that were never allocated cannot exist, checking
+	// the filter is cheaper than caching the result
+	if r.segmentFilter != nil && !r.segmentFilter.Contains(id) {
+		return "", model.ErrURLNotFound
+	}
+
+	urlEvent, err := r.linkStore.GetURL(id)
+	if err == nil && urlEvent.Domain != domain {
+		// the code belongs to another domain
+		err = model.ErrURLNotFound
+	}
+	if err != nil {
+		if errors.Is(err, model.ErrURLNotFound) {
+			r.addMissing(key)
+		}
+		return "", err
+	}
+
+	// the cache entry is capped to the link lifetime, so only links read from
+	// the store need to be checked for expiry
+	now := time.Now()
+	if urlEvent.Disabled || urlEvent.Deleted {
+		r.addGone(key)
+		return "", model.ErrURLGone
+	}
+	if urlEvent.IsExpired(now) {
+		r.addGone(key)
+		return "", ErrURLExpired
+	}
+
+	// a failed backfill only costs another store read on the next request
+	ttl := model.CacheTTL(now, urlEvent.ExpiresAt, r.options.URLTTL)
+	if err := r.cacheClient.AddURL(key, urlEvent.LongURL, ttl); err != nil {
+		log.Printf("Error backfilling URL in cache: %v", err)
+	}
+	r.addLocal(key, urlEvent.LongURL, ttl)
+
+	return urlEvent.LongURL, nil
+}
+
+// resolveID maps a short code of a domain to its numeric ID. Custom aliases
+// are resolved through the aliases table, codes that are not bound to an
+// alias fall back to the base62 decoding. Generated codes longer than 7
+// characters are also reserved in the aliases table, so they never collide
+// with an alias.
+func (r *Resolver) resolveID(domain string, shortURL string) (int64, error) {
+	id, err := codec.Base62ToInt64(shortURL)
+
+	if codec.IsValidAlias(shortURL) {
+		aliasID, aliasErr := r.linkStore.GetAliasID(codec.DomainKey(domain, shortURL))
+		if aliasErr == nil {
+			return aliasID, nil
+		}
+		if err != nil {
+			return 0, aliasErr
+		}
+	}
+
+	if err != nil {
+		return 0, ErrInvalidCode
+	}
+
+	return id, nil
+}
+
+// addMissing caches a not found result, failures are only logged
+func (r *Resolver) addMissing(shortURL string) {
+	if err := r.cacheClient.AddMissing(shortURL, r.options.NegativeTTL); err != nil {
+		log.Printf("Error caching missing URL: %v", err)
+	}
+}
+
+// addLocal stores a URL in the local cache if it is enabled
+func (r *Resolver) addLocal(shortURL string, longURL string, maxTTL time.Duration) {
+	if r.localCache != nil {
+		r.localCache.Set(shortURL, longURL, maxTTL)
+	}
+}
+
+// addGone caches a disabled, deleted or expired link, failures are only
+// logged
+func (r *Resolver) addGone(shortURL string) {
+	if err := r.cacheClient.AddGone(shortURL, r.options.URLTTL); err != nil {
+		log.Printf("Error caching gone URL: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package redirect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/store"
+)
+
+func TestResolverCapsLocalCacheToCacheTTL(t *testing.T) {
+	localCache := NewLocalCache(&LocalCacheOptions{Size: 10, TTL: time.Hour})
+	memoryCache := cache.NewMemoryCache(10)
+	options := &cache.Options{URLTTL: time.Hour, NegativeTTL: time.Minute}
+	resolver := NewResolver(localCache, memoryCache, store.NewMemoryStore(), nil, options)
+
+	// the cache entry of an expiring link lives until the link expires
+	if err := memoryCache.AddURL("0000001", "https://example.com", 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	longURL, err := resolver.Resolve("", "0000001")
+	if err != nil || longURL != "https://example.com" {
+		t.Fatalf("Resolve() = %q, %v", longURL, err)
+	}
+	if _, ok := localCache.Get("0000001"); !ok {
+		t.Fatal("link not added to the local cache")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := localCache.Get("0000001"); ok {
+		t.Error("local cache outlived the cache entry")
+	}
+}
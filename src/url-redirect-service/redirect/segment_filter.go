@@ -0,0 +1,207 @@
+package redirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// SegmentFilter tracks the ID segments of the first generation handed out by
+// the url-shorten-service, fed from the allocation records it writes to etcd. Codes decoding to an
+// unallocated segment can be rejected without touching Cassandra.
+//
+// There are at most max_segment_count segments, so an exact bitset is both
+// smaller and cheaper than a Bloom filter and never gives false positives.
+type SegmentFilter struct {
+	bits        []uint64    // one bit per segment, 1-based segment IDs
+	ready       atomic.Bool // false until the initial load completes
+	etcdClient  *clientv3.Client
+	options     *SegmentFilterOptions
+	etcdOptions *EtcdOptions
+}
+
+type SegmentFilterOptions struct {
+	Enabled         bool   `mapstructure:"enabled"`           // enable the segment filter
+	SegmentAllocKey string `mapstructure:"segment_alloc_key"` // key prefix recording allocated segments in etcd
+	SegmentSize     int    `mapstructure:"segment_size"`      // size of a segment, must match the url-shorten-service
+	MaxSegmentCount int    `mapstructure:"max_segment_count"` // maximum number of segments
+}
+
+type EtcdOptions struct {
+	Address        string        `mapstructure:"address"`         // etcd address
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout"` // timeout in seconds
+	RequestTimeout time.Duration `mapstructure:"request_timeout"` // timeout in seconds
+}
+
+// segmentFilterPageSize is the number of allocation records read per request
+// during the initial load
+const segmentFilterPageSize = 10000
+
+func NewSegmentFilter(options *SegmentFilterOptions, etcdOptions *EtcdOptions) (*SegmentFilter, func(), error) {
+	if options.SegmentSize <= 0 || options.MaxSegmentCount <= 0 {
+		return nil, nil, errors.New("segment size and max segment count must be positive")
+	}
+
+	// create a new etcd client
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{etcdOptions.Address},
+		DialTimeout: etcdOptions.ConnectTimeout,
+	})
+	if err != nil {
+		return nil, nil, errors.New("failed to connect to etcd: " + err.Error())
+	}
+
+	log.Println("Connected to etcd at", etcdOptions.Address)
+
+	filter := &SegmentFilter{
+		bits:        make([]uint64, options.MaxSegmentCount/64+1),
+		etcdClient:  etcdClient,
+		options:     options,
+		etcdOptions: etcdOptions,
+	}
+
+	// keep the filter in sync in the background, until it is loaded every
+	// code is let through
+	ctx, cancel := context.WithCancel(context.Background())
+	go filter.run(ctx)
+
+	return filter, func() {
+		cancel()
+		if err := etcdClient.Close(); err != nil {
+			log.Println("failed to close etcd client:", err)
+		}
+	}, nil
+}
+
+// Contains reports whether the segment of the given ID may have been
+// allocated. It always returns true until the filter is loaded.
+func (f *SegmentFilter) Contains(id int64) bool {
+	if !f.ready.Load() {
+		return true
+	}
+
+	if id <= 0 {
+		return false
+	}
+
+	// the filter tracks the first generation of 7 character codes, ids of
+	// later generations are not checked
+	if id >= codec.GenerationLimit(1) {
+		return true
+	}
+
+	segmentId := (id-1)/int64(f.options.SegmentSize) + 1
+	if segmentId > int64(f.options.MaxSegmentCount) {
+		return false
+	}
+
+	word := atomic.LoadUint64(&f.bits[segmentId/64])
+	return word&(1<<(segmentId%64)) != 0
+}
+
+// add marks a segment as allocated
+func (f *SegmentFilter) add(segmentId int) {
+	if segmentId <= 0 || segmentId > f.options.MaxSegmentCount {
+		return
+	}
+
+	addr := &f.bits[segmentId/64]
+	mask := uint64(1) << (segmentId % 64)
+	for {
+		word := atomic.LoadUint64(addr)
+		if word&mask != 0 || atomic.CompareAndSwapUint64(addr, word, word|mask) {
+			return
+		}
+	}
+}
+
+// run loads all allocation records and then follows new allocations with a
+// watch. The filter is reloaded whenever the watch breaks.
+func (f *SegmentFilter) run(ctx context.Context) {
+	prefix := f.options.SegmentAllocKey + "/"
+
+	for ctx.Err() == nil {
+		revision, err := f.load(ctx, prefix)
+		if err != nil {
+			log.Println("failed to load segment filter:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		f.ready.Store(true)
+		log.Println("Segment filter loaded at revision", revision)
+
+		watchCh := f.etcdClient.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+		for resp := range watchCh {
+			if err := resp.Err(); err != nil {
+				log.Println("segment filter watch failed:", err)
+				break
+			}
+			for _, ev := range resp.Events {
+				if ev.Type == clientv3.EventTypePut {
+					f.addKey(string(ev.Kv.Key), prefix)
+				}
+			}
+		}
+
+		// allocations may be missed until the reload completes
+		f.ready.Store(false)
+	}
+}
+
+// load reads every allocation record page by page at a single revision and
+// returns that revision
+func (f *SegmentFilter) load(ctx context.Context, prefix string) (int64, error) {
+	var revision int64
+	key := prefix
+	end := clientv3.GetPrefixRangeEnd(prefix)
+
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, f.etcdOptions.RequestTimeout)
+		opts := []clientv3.OpOption{
+			clientv3.WithRange(end),
+			clientv3.WithKeysOnly(),
+			clientv3.WithLimit(segmentFilterPageSize),
+		}
+		if revision != 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		resp, err := f.etcdClient.Get(reqCtx, key, opts...)
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get allocated segments: %v", err)
+		}
+
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+
+		for _, kv := range resp.Kvs {
+			f.addKey(string(kv.Key), prefix)
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return revision, nil
+		}
+
+		// continue right after the last key of this page
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+func (f *SegmentFilter) addKey(key string, prefix string) {
+	segmentId, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+	if err != nil {
+		log.Println("invalid segment allocation key:", key)
+		return
+	}
+	f.add(segmentId)
+}
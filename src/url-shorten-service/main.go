@@ -1,230 +1,297 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/spf13/viper"
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/cassandra"
+	"github.com/qninhdt/chopurl/src/shared/config"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/qninhdt/chopurl/src/url-shorten-service/shorten"
 	"github.com/valyala/fasthttp"
+
+	// database/sql drivers of the postgres and sqlite link stores
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
 
 	// load configuration
-	v := viper.New()
-	v.SetConfigName("config")
-	v.SetConfigType("yaml")
-	v.AddConfigPath(".")
+	v, err := config.Load()
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
 
-	if err := v.ReadInConfig(); err != nil {
-		log.Fatal("Error reading config file: ", err)
+	// bind to shorten.IdClientOptions
+	var idClientOptions shorten.IdClientOptions
+	if err := v.UnmarshalKey("id_alloc_client", &idClientOptions); err != nil {
+		log.Fatal("Error unmarshalling ID Client options: ", err)
 	}
 
-	v.AutomaticEnv()
-	v.SetEnvPrefix("")
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	idClientOptions.Address = os.Getenv("ID_ALLOC_ADDRESS")
+	if idClientOptions.Address == "" {
+		idClientOptions.Address = "id-alloc-service:9090"
+	}
+	if idClientOptions.Namespace == "" {
+		idClientOptions.Namespace = "urls"
+	}
+	if idClientOptions.Prefetch < 0 {
+		idClientOptions.Prefetch = 0
+	}
+	if idClientOptions.Timeout <= 0 {
+		idClientOptions.Timeout = 5 * time.Second
+	}
 
-	err := v.ReadInConfig()
+	// bind to cache.Options
+	cacheOptions, err := config.CacheOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Cache options: ", err)
+	}
 
+	// bind to cassandra.Options
+	cassandraOptions, err := config.CassandraOptions(v)
 	if err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			// Config file not found; ignore error if desired
-			log.Println("Config file not found; using default values")
-		} else {
-			// Config file was found but another error was produced
-			log.Fatal("Error reading config file: ", err)
-		}
-	} else {
-		log.Println("Using config file:", v.ConfigFileUsed())
+		log.Fatal("Error binding Cassandra options: ", err)
 	}
 
-	// bind to IdAllocatorOptions
-	var idAllocOptions IdAllocatorOptions
-	if err := v.UnmarshalKey("id_alloc", &idAllocOptions); err != nil {
-		log.Fatal("Error unmarshalling ID Allocator options: ", err)
+	// bind to store.Options
+	storeOptions, err := config.StoreOptions(v)
+	if err != nil {
+		log.Fatal("Error binding Store options: ", err)
 	}
 
-	// bind to EtcdOptions
-	var etcdOptions EtcdOptions
-	if err := v.UnmarshalKey("etcd", &etcdOptions); err != nil {
-		log.Fatal("Error unmarshalling Etcd options: ", err)
+	// bind to shorten.OutboxOptions
+	var outboxOptions shorten.OutboxOptions
+	if err := v.UnmarshalKey("outbox", &outboxOptions); err != nil {
+		log.Fatal("Error unmarshalling Outbox options: ", err)
 	}
 
-	etcdOptions.Address = os.Getenv("ETCD_ADDRESS")
+	if outboxOptions.Stream == "" {
+		outboxOptions.Stream = "url_outbox"
+	}
+	if outboxOptions.Group == "" {
+		outboxOptions.Group = "url-outbox-workers"
+	}
+	if outboxOptions.BatchSize <= 0 {
+		outboxOptions.BatchSize = 100
+	}
+	if outboxOptions.RetryInterval <= 0 {
+		outboxOptions.RetryInterval = 5 * time.Second
+	}
+	if outboxOptions.ClaimIdle <= 0 {
+		outboxOptions.ClaimIdle = 30 * time.Second
+	}
 
-	// bind to CacheOptions
-	var cacheOptions CacheOptions
-	if err := v.UnmarshalKey("redis", &cacheOptions); err != nil {
-		log.Fatal("Error unmarshalling Cache options: ", err)
+	// bind to shorten.ClickConsumerOptions
+	var clickConsumerOptions shorten.ClickConsumerOptions
+	if err := v.UnmarshalKey("kafka", &clickConsumerOptions); err != nil {
+		log.Fatal("Error unmarshalling Kafka options: ", err)
 	}
 
-	cacheOptions.SentinelAddress = os.Getenv("REDIS_SENTINEL_ADDRESS")
-	cacheOptions.MasterName = os.Getenv("REDIS_MASTER_NAME")
-	cacheOptions.Password = os.Getenv("REDIS_PASSWORD")
+	// Get Kafka brokers from environment variable (comma-separated list)
+	if kafkaBrokersEnv := os.Getenv("KAFKA_BROKERS"); kafkaBrokersEnv != "" {
+		clickConsumerOptions.Brokers = strings.Split(kafkaBrokersEnv, ",")
+	}
+	if clickConsumerOptions.Topic == "" {
+		clickConsumerOptions.Topic = "clicks"
+	}
+	if clickConsumerOptions.GroupID == "" {
+		clickConsumerOptions.GroupID = "click-aggregator"
+	}
+	if clickConsumerOptions.BatchSize <= 0 {
+		clickConsumerOptions.BatchSize = 1000
+	}
+	if clickConsumerOptions.FlushInterval <= 0 {
+		clickConsumerOptions.FlushInterval = 5 * time.Second
+	}
 
-	// bind to CassandraOptions
-	var cassandraOptions CassandraOptions
-	if err := v.UnmarshalKey("cassandra", &cassandraOptions); err != nil {
-		log.Fatal("Error unmarshalling Cassandra options: ", err)
+	// bind to shorten.AuthOptions
+	var authOptions shorten.AuthOptions
+	if err := v.UnmarshalKey("auth", &authOptions); err != nil {
+		log.Fatal("Error unmarshalling Auth options: ", err)
 	}
 
-	// Get Cassandra hosts from environment variable (comma-separated list)
-	cassandraHostsEnv := os.Getenv("CASSANDRA_HOSTS")
-	if cassandraHostsEnv != "" {
-		cassandraOptions.Hosts = strings.Split(cassandraHostsEnv, ",")
-	} else {
-		// Default hosts if not specified in environment
-		cassandraOptions.Hosts = []string{"cassandra-1", "cassandra-2", "cassandra-3"}
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		authOptions.AdminToken = adminToken
 	}
-	cassandraOptions.Keyspace = os.Getenv("CASSANDRA_KEYSPACE")
-	if cassandraOptions.Keyspace == "" {
-		cassandraOptions.Keyspace = "chopurl_keyspace"
+	if authOptions.CacheTTL == 0 {
+		authOptions.CacheTTL = 30 * time.Second
 	}
 
-	// init id allocator
-	idAllocator, cleanup, err := NewIdAllocator(&idAllocOptions, &etcdOptions)
-	if err != nil {
-		log.Fatal("Error initializing ID Allocator: ", err)
+	// bind to shorten.DomainOptions
+	var domainOptions shorten.DomainOptions
+	if err := v.UnmarshalKey("domains", &domainOptions); err != nil {
+		log.Fatal("Error unmarshalling Domain options: ", err)
 	}
-	defer cleanup()
 
-	// init cache client
-	cacheClient, cleanup, err := NewCacheClient(&cacheOptions)
-	if err != nil {
-		log.Fatal("Error initializing Cache Client: ", err)
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		domainOptions.BaseURL = baseURL
+	}
+	if domainOptions.BaseURL == "" {
+		domainOptions.BaseURL = "http://localhost/short/"
 	}
-	defer cleanup()
 
-	// init cassandra client
-	cassandraClient, cleanup, err := NewCassandraClient(&cassandraOptions)
+	domains, err := shorten.NewDomains(&domainOptions)
 	if err != nil {
-		log.Fatal("Error initializing Cassandra Client: ", err)
+		log.Fatal("Error in Domain options: ", err)
 	}
-	defer cleanup()
 
-	// Add CORS and rate limiting middleware
-	middleware := func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
-		return func(ctx *fasthttp.RequestCtx) {
-			// Add CORS headers
-			// ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
-			// ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-			// ctx.Response.Header.Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, X-CSRF-Token")
-			// ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
-			// ctx.Response.Header.Set("Access-Control-Max-Age", "86400") // 24 hours
-
-			// Handle preflight requests
-			if string(ctx.Method()) == "OPTIONS" {
-				ctx.SetStatusCode(fasthttp.StatusNoContent)
-				return
-			}
-
-			// Call the original handler
-			h(ctx)
-		}
+	// bind to shorten.ServerOptions
+	var serverOptions shorten.ServerOptions
+	if err := v.UnmarshalKey("server", &serverOptions); err != nil {
+		log.Fatal("Error unmarshalling Server options: ", err)
 	}
 
-	// simple POST /create
-	// JSON body: {"long_url": "http://example.com"} -> {"short_url": "http://short.url/123456"}
-	createHandler := func(ctx *fasthttp.RequestCtx) {
-		if !ctx.IsPost() {
-			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
-			return
-		}
-
-		var requestBody struct {
-			LongURL string `json:"long_url"`
-		}
-
-		if err := json.Unmarshal(ctx.PostBody(), &requestBody); err != nil {
-			ctx.Error("Invalid request body", fasthttp.StatusBadRequest)
-			return
-		}
-
-		if !IsValidURL(requestBody.LongURL) {
-			ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
-			return
-		}
-
-		// generate a unique ID for the URL
-		id, err := idAllocator.Pop()
-		if err != nil {
-			ctx.Error("Error allocating ID", fasthttp.StatusInternalServerError)
-			return
-		}
+	if serverOptions.Port == "" {
+		serverOptions.Port = "8080"
+	}
+	if serverOptions.ShutdownTimeout <= 0 {
+		serverOptions.ShutdownTimeout = 10 * time.Second
+	}
+	if serverOptions.MaxBatchSize <= 0 {
+		serverOptions.MaxBatchSize = 50000
+	}
+	if serverOptions.MaxRequestBodySize <= 0 {
+		serverOptions.MaxRequestBodySize = 16 * 1024 * 1024
+	}
 
-		// convert the ID to a base62 string
-		shortURL := Int64ToBase62(id)
+	// the X-Real-IP header is only trusted from these proxies
+	trustedProxies, err := shorten.NewTrustedProxies(serverOptions.TrustedProxies)
+	if err != nil {
+		log.Fatal("Error in Server options: ", err)
+	}
 
-		log.Printf("Generated id base10=%d, base62=%s\n", id, shortURL)
+	// bind to shorten.RateLimitOptions
+	var rateLimitOptions shorten.RateLimitOptions
+	if err := v.UnmarshalKey("server", &rateLimitOptions); err != nil {
+		log.Fatal("Error unmarshalling Rate Limit options: ", err)
+	}
 
-		// Current timestamp for creation time
-		now := time.Now()
+	if !rateLimitOptions.DisableRateLimit && rateLimitOptions.MaxRPS <= 0 {
+		log.Fatal("Error in Rate Limit options: max_rps must be positive")
+	}
+	if rateLimitOptions.Burst <= 0 {
+		rateLimitOptions.Burst = int(math.Ceil(rateLimitOptions.MaxRPS))
+	}
 
-		// store the mapping in the cache
-		if err := cacheClient.AddURL(shortURL, requestBody.LongURL, 24*time.Hour); err != nil {
-			ctx.Error("Error storing URL in cache", fasthttp.StatusInternalServerError)
-			return
-		}
+	// init cache client
+	cacheClient, cleanup, err := cache.NewClient(cacheOptions)
+	if err != nil {
+		log.Fatal("Error initializing Cache Client: ", err)
+	}
+	defer cleanup()
 
-		// Create URL event
-		urlEvent := &URLEvent{
-			LongURL:   requestBody.LongURL,
-			CreatedAt: now,
-			ID:        id,
-		}
+	// init id client, the ids are allocated by the id allocation service
+	idClient, cleanup, err := shorten.NewIdClient(&idClientOptions)
+	if err != nil {
+		log.Fatal("Error initializing ID Client: ", err)
+	}
+	defer cleanup()
 
-		// Save URL to Cassandra
-		if err := cassandraClient.SaveURL(urlEvent); err != nil {
-			log.Printf("Error saving URL to Cassandra: %v", err)
-			// We don't return an error to the client here, as the URL is already in cache
-			// The URL may be persisted later by a background process or retry mechanism
-		} else {
-			log.Printf("URL saved to Cassandra: id=%d", id)
+	// init cassandra client, it holds the API keys and the click counters, and
+	// the links with the cassandra backend
+	var cassandraClient *shorten.CassandraClient
+	if storeOptions.Backend == "cassandra" || authOptions.Enabled || len(clickConsumerOptions.Brokers) > 0 {
+		cassandraClient, cleanup, err = shorten.NewCassandraClient(cassandraOptions)
+		if err != nil {
+			log.Fatal("Error initializing Cassandra Client: ", err)
 		}
+		defer cleanup()
+	} else {
+		log.Println("Cassandra is not used; API keys and link stats are unavailable")
+	}
 
-		// return the short URL
-		response := struct {
-			ShortURL string `json:"short_url"`
-		}{
-			ShortURL: "http://localhost/short/" + shortURL,
-		}
+	// init link store
+	var storeCassandra *cassandra.Client
+	if cassandraClient != nil {
+		storeCassandra = cassandraClient.Client
+	}
+	linkStore, cleanup, err := store.New(storeOptions, storeCassandra)
+	if err != nil {
+		log.Fatal("Error initializing Link Store: ", err)
+	}
+	defer cleanup()
 
-		ctx.SetContentType("application/json")
-		ctx.SetStatusCode(fasthttp.StatusOK)
+	// init outbox, links whose store write failed are saved by its worker
+	outbox, cleanup, err := shorten.NewOutbox(&outboxOptions, cacheClient, linkStore)
+	if err != nil {
+		log.Fatal("Error initializing Outbox: ", err)
+	}
+	defer cleanup()
 
-		responseJSON, err := json.Marshal(response)
+	// init click consumer, it aggregates the click events of the redirect service
+	if len(clickConsumerOptions.Brokers) > 0 {
+		_, cleanup, err := shorten.NewClickConsumer(&clickConsumerOptions, cassandraClient, linkStore)
 		if err != nil {
-			ctx.Error("Error encoding response", fasthttp.StatusInternalServerError)
-			return
+			log.Fatal("Error initializing Click Consumer: ", err)
 		}
-		ctx.Write(responseJSON)
+		defer cleanup()
+	} else {
+		log.Println("No kafka brokers configured; clicks are not aggregated")
 	}
 
-	// health check
-	healthHandler := func(ctx *fasthttp.RequestCtx) {
-		ctx.SetStatusCode(fasthttp.StatusOK)
-		ctx.Write([]byte("OK"))
+	// init authenticator, API keys are stored in Cassandra
+	authenticator := shorten.NewAuthenticator(&authOptions, cassandraClient)
+
+	// init rate limiter
+	var rateLimiter shorten.RateLimiter
+	if rateLimitOptions.DisableRateLimit {
+		log.Println("Rate limiting is disabled")
+	} else if rateLimitOptions.Shared {
+		rateLimiter = shorten.NewRedisRateLimiter(&rateLimitOptions, cacheClient)
+	} else {
+		localRateLimiter, cleanup := shorten.NewLocalRateLimiter(&rateLimitOptions)
+		defer cleanup()
+		rateLimiter = localRateLimiter
 	}
 
-	// Set up the handler
-	router := func(ctx *fasthttp.RequestCtx) {
-		path := string(ctx.Path())
-		switch path {
-		case "/create":
-			createHandler(ctx)
-		case "/health":
-			healthHandler(ctx)
-		default:
-			ctx.Error("Not found", fasthttp.StatusNotFound)
-		}
+	// the routes of the shorten API behind authentication and rate limiting
+	handler := shorten.NewHandler(&shorten.Dependencies{
+		Cache:          cacheClient,
+		CacheOptions:   cacheOptions,
+		IdPool:         idClient,
+		LinkStore:      linkStore,
+		Cassandra:      cassandraClient,
+		Outbox:         outbox,
+		Authenticator:  authenticator,
+		AuthOptions:    &authOptions,
+		RateLimiter:    rateLimiter,
+		TrustedProxies: trustedProxies,
+		Domains:        domains,
+		ServerOptions:  &serverOptions,
+	})
+
+	server := &fasthttp.Server{
+		Handler:            handler,
+		MaxRequestBodySize: serverOptions.MaxRequestBodySize,
 	}
 
-	var port string = "8080"
-	log.Println("Starting server on port", port)
-	if err := fasthttp.ListenAndServe(":"+port, middleware(router)); err != nil {
-		log.Fatal("Error starting server: ", err)
+	go func() {
+		log.Println("Starting server on port", serverOptions.Port)
+		if err := server.ListenAndServe(":" + serverOptions.Port); err != nil {
+			log.Fatal("Error starting server: ", err)
+		}
+	}()
+
+	// wait for a termination signal
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	// stop accepting connections and drain in-flight requests before the
+	// deferred cleanups close the clients
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverOptions.ShutdownTimeout)
+	defer cancel()
+	if err := server.ShutdownWithContext(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
 	}
 }
@@ -0,0 +1,174 @@
+package shorten
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrAPIKeyRevoked = errors.New("API key has been revoked")
+)
+
+// user values set on authenticated requests
+const (
+	ownerKey = "owner"  // owner of the API key
+	keyIDKey = "key_id" // ID of the API key
+)
+
+// APIKey is an API key of a link owner. Only the SHA-256 hash of the secret
+// is stored, the full key "<key_id>.<secret>" is returned once on creation.
+type APIKey struct {
+	KeyID      string    `json:"key_id"`
+	Owner      string    `json:"owner"`
+	SecretHash string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	Revoked    bool      `json:"revoked"`
+}
+
+type AuthOptions struct {
+	Enabled    bool          `mapstructure:"enabled"`     // require an API key on /create, /links and /stats
+	AdminToken string        `mapstructure:"admin_token"` // token of the /keys admin endpoints, disabled when empty
+	CacheTTL   time.Duration `mapstructure:"cache_ttl"`   // how long a key is trusted before it is read again, bounds revocation delay
+}
+
+// Authenticator checks API keys against Cassandra. Keys are cached for a
+// short while so every request does not cost a Cassandra read.
+type Authenticator struct {
+	cassandraClient *CassandraClient
+	options         *AuthOptions
+	lock            sync.Mutex
+	cache           map[string]*cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	apiKey    *APIKey
+	expiresAt time.Time
+}
+
+func NewAuthenticator(options *AuthOptions, cassandraClient *CassandraClient) *Authenticator {
+	return &Authenticator{
+		cassandraClient: cassandraClient,
+		options:         options,
+		cache:           make(map[string]*cachedAPIKey),
+	}
+}
+
+// Authenticate validates a "Bearer <key_id>.<secret>" authorization header
+func (a *Authenticator) Authenticate(authorization string) (*APIKey, error) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	keyID, secret, ok := strings.Cut(token, ".")
+	if !ok || keyID == "" || secret == "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	apiKey, err := a.getKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(apiKey.SecretHash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if apiKey.Revoked {
+		return nil, ErrAPIKeyRevoked
+	}
+
+	return apiKey, nil
+}
+
+// IsAdmin reports whether token is the admin token
+func (a *Authenticator) IsAdmin(token string) bool {
+	if a.options.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.options.AdminToken)) == 1
+}
+
+// CreateKey creates an API key for owner and returns it with its full token
+func (a *Authenticator) CreateKey(owner string) (*APIKey, string, error) {
+	keyID, err := codec.RandomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := codec.RandomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiKey := &APIKey{
+		KeyID:      keyID,
+		Owner:      owner,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  time.Now(),
+	}
+
+	if err := a.cassandraClient.SaveAPIKey(apiKey); err != nil {
+		return nil, "", err
+	}
+
+	return apiKey, keyID + "." + secret, nil
+}
+
+// RevokeKey revokes an API key, other instances stop accepting it once
+// their cached copy expires
+func (a *Authenticator) RevokeKey(keyID string) error {
+	if err := a.cassandraClient.RevokeAPIKey(keyID); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	delete(a.cache, keyID)
+	a.lock.Unlock()
+
+	return nil
+}
+
+func (a *Authenticator) getKey(keyID string) (*APIKey, error) {
+	now := time.Now()
+
+	a.lock.Lock()
+	cached, ok := a.cache[keyID]
+	a.lock.Unlock()
+
+	if ok && now.Before(cached.expiresAt) {
+		return cached.apiKey, nil
+	}
+
+	apiKey, err := a.cassandraClient.GetAPIKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	a.cache[keyID] = &cachedAPIKey{apiKey: apiKey, expiresAt: now.Add(a.options.CacheTTL)}
+	a.lock.Unlock()
+
+	return apiKey, nil
+}
+
+// RequestOwner returns the owner of the API key of the request, it is empty
+// when authentication is disabled
+func RequestOwner(ctx *fasthttp.RequestCtx) string {
+	owner, _ := ctx.UserValue(ownerKey).(string)
+	return owner
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,90 @@
+package shorten
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+)
+
+// batchWriteConcurrency is the number of concurrent writes of SaveURLs
+const batchWriteConcurrency = 32
+
+// batchChunkSize is the number of items of a batch processed together, the
+// results of a chunk are streamed before the next one starts
+const batchChunkSize = 1000
+
+// BatchItem is a link to create in a batch, it takes the fields of /create
+type BatchItem struct {
+	LongURL    string     `json:"long_url"`
+	Alias      string     `json:"alias"`
+	Domain     string     `json:"domain"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	TTLSeconds int64      `json:"ttl_seconds"`
+}
+
+// BatchResult is the outcome of a batch item, results keep the input order
+type BatchResult struct {
+	Index     int        `json:"index"`
+	ShortURL  string     `json:"short_url,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// ParseBatch decodes a batch from a JSON array, or from NDJSON with one item
+// per line. Blank NDJSON lines are skipped.
+func ParseBatch(body []byte, ndjson bool, maxItems int) ([]BatchItem, error) {
+	var items []BatchItem
+
+	if !ndjson {
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, errors.New("invalid JSON array: " + err.Error())
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+
+			var item BatchItem
+			if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+				return nil, fmt.Errorf("invalid JSON on line %d: %v", line, err)
+			}
+			items = append(items, item)
+
+			if len(items) > maxItems {
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.New("invalid NDJSON: " + err.Error())
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("batch is empty")
+	}
+	if len(items) > maxItems {
+		return nil, fmt.Errorf("batch has more than %d items", maxItems)
+	}
+
+	return items, nil
+}
+
+// SaveURLs saves many URLs with concurrent writes, with Cassandra they may
+// belong to any partition so a batch would only add coordinator load. It
+// returns the error of every URL in order.
+func SaveURLs(linkStore store.LinkStore, urlEvents []*model.URLEvent) []error {
+	errs := make([]error, len(urlEvents))
+	ForEachConcurrent(len(urlEvents), batchWriteConcurrency, func(i int) {
+		errs[i] = linkStore.SaveURL(urlEvents[i])
+	})
+	return errs
+}
@@ -0,0 +1,88 @@
+package shorten
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+)
+
+func TestParseBatch(t *testing.T) {
+	items, err := ParseBatch([]byte(`[{"long_url": "https://a.example"}, {"long_url": "https://b.example", "alias": "b-link", "ttl_seconds": 60}]`), false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].Alias != "b-link" || items[1].TTLSeconds != 60 {
+		t.Errorf("ParseBatch() = %+v", items)
+	}
+
+	items, err = ParseBatch([]byte("{\"long_url\": \"https://a.example\"}\n\n  \n{\"long_url\": \"https://b.example\", \"domain\": \"go.example\"}\n"), true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].Domain != "go.example" {
+		t.Errorf("ParseBatch() = %+v", items)
+	}
+
+	invalid := []struct {
+		name   string
+		body   string
+		ndjson bool
+	}{
+		{name: "empty array", body: `[]`},
+		{name: "not an array", body: `{"long_url": "https://a.example"}`},
+		{name: "too many items", body: `[{}, {}, {}, {}]`},
+		{name: "empty ndjson", body: "\n\n", ndjson: true},
+		{name: "invalid line", body: "{}\nnot json\n", ndjson: true},
+		{name: "too many lines", body: strings.Repeat("{}\n", 4), ndjson: true},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if items, err := ParseBatch([]byte(tt.body), tt.ndjson, 3); err == nil {
+				t.Errorf("ParseBatch() = %+v, want an error", items)
+			}
+		})
+	}
+
+	// the line number of an invalid item is reported
+	if _, err := ParseBatch([]byte("{}\n{\n"), true, 3); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ParseBatch() error = %v, want line 2", err)
+	}
+}
+
+// failingStore fails the writes of the odd IDs
+type failingStore struct {
+	store.LinkStore
+	saved atomic.Int64
+}
+
+func (s *failingStore) SaveURL(urlEvent *model.URLEvent) error {
+	if urlEvent.ID%2 == 1 {
+		return errors.New("write failed")
+	}
+	s.saved.Add(1)
+	return s.LinkStore.SaveURL(urlEvent)
+}
+
+func TestSaveURLs(t *testing.T) {
+	linkStore := &failingStore{LinkStore: store.NewMemoryStore()}
+
+	urlEvents := make([]*model.URLEvent, 100)
+	for i := range urlEvents {
+		urlEvents[i] = &model.URLEvent{ID: int64(i + 1), LongURL: "https://example.com", CreatedAt: time.Now()}
+	}
+
+	errs := SaveURLs(linkStore, urlEvents)
+	for i, err := range errs {
+		if (err != nil) != (urlEvents[i].ID%2 == 1) {
+			t.Errorf("error of ID %d = %v", urlEvents[i].ID, err)
+		}
+	}
+	if saved := linkStore.saved.Load(); saved != 50 {
+		t.Errorf("saved %d URLs, want 50", saved)
+	}
+}
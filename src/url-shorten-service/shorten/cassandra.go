@@ -0,0 +1,64 @@
+package shorten
+
+import (
+	"errors"
+
+	"github.com/gocql/gocql"
+	"github.com/qninhdt/chopurl/src/shared/cassandra"
+)
+
+// CassandraClient adds the API key and click tables to the shared client,
+// the links are read and written through the link store
+type CassandraClient struct {
+	*cassandra.Client
+}
+
+// NewCassandraClient creates a new Cassandra client
+func NewCassandraClient(options *cassandra.Options) (*CassandraClient, func(), error) {
+	client, cleanup, err := cassandra.NewClient(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &CassandraClient{Client: client}, cleanup, nil
+}
+
+// SaveAPIKey saves an API key to Cassandra
+func (c *CassandraClient) SaveAPIKey(apiKey *APIKey) error {
+	query := "INSERT INTO api_keys (key_id, owner, secret_hash, created_at, revoked) VALUES (?, ?, ?, ?, ?)"
+	if err := c.Session().Query(query, apiKey.KeyID, apiKey.Owner, apiKey.SecretHash, apiKey.CreatedAt,
+		apiKey.Revoked).Exec(); err != nil {
+		return errors.New("failed to save API key to Cassandra: " + err.Error())
+	}
+
+	return nil
+}
+
+// GetAPIKey retrieves an API key from Cassandra by its ID
+func (c *CassandraClient) GetAPIKey(keyID string) (*APIKey, error) {
+	var apiKey APIKey
+	query := "SELECT key_id, owner, secret_hash, created_at, revoked FROM api_keys WHERE key_id = ? LIMIT 1"
+	if err := c.Session().Query(query, keyID).Scan(&apiKey.KeyID, &apiKey.Owner, &apiKey.SecretHash, &apiKey.CreatedAt,
+		&apiKey.Revoked); err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, errors.New("failed to get API key from Cassandra: " + err.Error())
+	}
+
+	return &apiKey, nil
+}
+
+// RevokeAPIKey marks an API key as revoked
+func (c *CassandraClient) RevokeAPIKey(keyID string) error {
+	query := "UPDATE api_keys SET revoked = true WHERE key_id = ? IF EXISTS"
+	applied, err := c.Session().Query(query, keyID).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return errors.New("failed to revoke API key in Cassandra: " + err.Error())
+	}
+	if !applied {
+		return ErrInvalidAPIKey
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/segmentio/kafka-go"
+)
+
+// ClickConsumer reads click events from Kafka and aggregates them into the
+// Cassandra counter tables. Offsets are committed only after the counters
+// are written, so a crash may count a batch twice but never loses it.
+// Events carry the code of the request, aliases are mapped to the ID of
+// their link so every code of a link is counted under one key.
+type ClickConsumer struct {
+	reader          *kafka.Reader
+	cassandraClient *CassandraClient
+	linkStore       store.LinkStore
+	linkKeys        map[string]string // domain scoped code -> link key, cleared on every flush
+	options         *ClickConsumerOptions
+}
+
+type ClickConsumerOptions struct {
+	Brokers       []string      `mapstructure:"brokers"`        // kafka brokers, clicks are not aggregated when empty
+	Topic         string        `mapstructure:"topic"`          // topic of the click events
+	GroupID       string        `mapstructure:"group_id"`       // consumer group shared by all instances
+	BatchSize     int           `mapstructure:"batch_size"`     // maximum number of events per flush
+	FlushInterval time.Duration `mapstructure:"flush_interval"` // maximum delay before the counters are flushed
+}
+
+func NewClickConsumer(options *ClickConsumerOptions, cassandraClient *CassandraClient, linkStore store.LinkStore) (*ClickConsumer, func(), error) {
+	if len(options.Brokers) == 0 {
+		return nil, nil, errors.New("no kafka brokers configured")
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  options.Brokers,
+		GroupID:  options.GroupID,
+		Topic:    options.Topic,
+		MinBytes: 1,
+		MaxBytes: 10e6,
+	})
+
+	log.Println("Consuming click events from kafka at", options.Brokers)
+
+	consumer := &ClickConsumer{
+		reader:          reader,
+		cassandraClient: cassandraClient,
+		linkStore:       linkStore,
+		linkKeys:        make(map[string]string),
+		options:         options,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.run(ctx)
+	}()
+
+	return consumer, func() {
+		cancel()
+		<-done
+		if err := reader.Close(); err != nil {
+			log.Println("failed to close kafka reader:", err)
+		}
+	}, nil
+}
+
+func (c *ClickConsumer) run(ctx context.Context) {
+	counts := NewClickCounts()
+	var pending []kafka.Message
+	flushAt := time.Now().Add(c.options.FlushInterval)
+
+	for {
+		fetchCtx, cancel := context.WithDeadline(ctx, flushAt)
+		msg, err := c.reader.FetchMessage(fetchCtx)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				log.Println("failed to fetch click event:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+		} else {
+			pending = append(pending, msg)
+
+			var event model.ClickEvent
+			if err := json.Unmarshal(msg.Value, &event); err != nil {
+				log.Println("invalid click event:", err)
+			} else {
+				key, err := c.linkKey(ctx, &event)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Println("click event of an unknown code:", event.Code)
+				} else {
+					counts.Add(key, &event)
+				}
+			}
+		}
+
+		if len(pending) < c.options.BatchSize && time.Now().Before(flushAt) {
+			continue
+		}
+
+		if err := c.flush(ctx, counts, pending); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// keep the counters left to write and try again on the next round
+			log.Println("failed to flush click counters:", err)
+			time.Sleep(time.Second)
+		} else {
+			counts = NewClickCounts()
+			pending = pending[:0]
+			clear(c.linkKeys)
+		}
+
+		flushAt = time.Now().Add(c.options.FlushInterval)
+	}
+}
+
+// linkKey returns the codec.LinkKey of the link a click event was counted
+// for. Store failures are retried until ctx is done, only codes that are
+// bound to no link return an error.
+func (c *ClickConsumer) linkKey(ctx context.Context, event *model.ClickEvent) (string, error) {
+	scoped := codec.DomainKey(event.Domain, event.Code)
+	if key, ok := c.linkKeys[scoped]; ok {
+		return key, nil
+	}
+
+	for {
+		id, err := c.resolveID(event.Domain, event.Code)
+		if err == nil {
+			key := codec.LinkKey(event.Domain, id)
+			c.linkKeys[scoped] = key
+			return key, nil
+		}
+		if errors.Is(err, model.ErrURLNotFound) {
+			return "", err
+		}
+
+		log.Println("failed to resolve click event code:", err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// resolveID maps a code of a domain to the ID of its link like the redirect
+// service does: aliases first, then the base62 decoding
+func (c *ClickConsumer) resolveID(domain string, code string) (int64, error) {
+	id, decodeErr := codec.Base62ToInt64(code)
+
+	if codec.IsValidAlias(code) {
+		aliasID, err := c.linkStore.GetAliasID(codec.DomainKey(domain, code))
+		if err == nil {
+			return aliasID, nil
+		}
+		if !errors.Is(err, model.ErrURLNotFound) {
+			return 0, err
+		}
+	}
+
+	if decodeErr != nil {
+		return 0, model.ErrURLNotFound
+	}
+
+	return id, nil
+}
+
+// flush writes the aggregated counters and commits the consumed offsets
+func (c *ClickConsumer) flush(ctx context.Context, counts *ClickCounts, pending []kafka.Message) error {
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if !counts.Empty() {
+		if err := c.cassandraClient.AddClicks(counts); err != nil {
+			return err
+		}
+		// the counters are written, never apply them twice
+		counts.Reset()
+	}
+
+	if err := c.reader.CommitMessages(ctx, pending...); err != nil {
+		return errors.New("failed to commit click events: " + err.Error())
+	}
+
+	return nil
+}
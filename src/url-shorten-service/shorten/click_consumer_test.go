@@ -0,0 +1,43 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+)
+
+func TestClickConsumerLinkKey(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	if _, err := linkStore.ReserveAlias("my-link", 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := linkStore.ReserveAlias("brand.example/my-link", 2, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ClickConsumer{linkStore: linkStore, linkKeys: make(map[string]string)}
+
+	tests := []struct {
+		domain, code, want string
+	}{
+		// the alias and the generated code of a link share the key
+		{code: "my-link", want: "0000001"},
+		{code: "0000001", want: "0000001"},
+		{domain: "brand.example", code: "my-link", want: "brand.example/0000002"},
+		{domain: "brand.example", code: "0000002", want: "brand.example/0000002"},
+	}
+	for _, tt := range tests {
+		got, err := c.linkKey(context.Background(), &model.ClickEvent{Domain: tt.domain, Code: tt.code})
+		if err != nil || got != tt.want {
+			t.Errorf("linkKey(%q, %q) = %q, %v, want %q", tt.domain, tt.code, got, err, tt.want)
+		}
+	}
+
+	if _, err := c.linkKey(context.Background(), &model.ClickEvent{Code: "no-such-alias"}); !errors.Is(err, model.ErrURLNotFound) {
+		t.Errorf("linkKey(no-such-alias) error = %v, want ErrURLNotFound", err)
+	}
+}
@@ -0,0 +1,90 @@
+package shorten
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+
+	"github.com/qninhdt/chopurl/src/shared/codec"
+)
+
+var (
+	ErrUnknownDomain    = errors.New("unknown domain")
+	ErrDomainNotAllowed = errors.New("domain not allowed for this API key")
+)
+
+type DomainOptions struct {
+	BaseURL string         `mapstructure:"base_url"` // public base URL of the default domain, the code is appended to it
+	Custom  []CustomDomain `mapstructure:"custom"`   // branded domains, links are created on one with the "domain" field
+}
+
+type CustomDomain struct {
+	Host    string   `mapstructure:"host"`     // host of the domain, matched against the Host header by the redirect service
+	BaseURL string   `mapstructure:"base_url"` // public base URL of the domain, the code is appended to it
+	Owners  []string `mapstructure:"owners"`   // owners allowed to create links on the domain, every owner when empty
+}
+
+// Domains maps the domain of a link to its public URL. Every custom domain is
+// an independent namespace of aliases, the default domain is the empty one.
+type Domains struct {
+	custom  map[string]*CustomDomain
+	options *DomainOptions
+}
+
+func NewDomains(options *DomainOptions) (*Domains, error) {
+	if !isValidBaseURL(options.BaseURL) {
+		return nil, errors.New("invalid base URL: " + options.BaseURL)
+	}
+
+	custom := make(map[string]*CustomDomain, len(options.Custom))
+	for i := range options.Custom {
+		domain := &options.Custom[i]
+		domain.Host = codec.NormalizeHost(domain.Host)
+		if domain.Host == "" {
+			return nil, errors.New("custom domain without a host")
+		}
+		if !isValidBaseURL(domain.BaseURL) {
+			return nil, errors.New("invalid base URL of domain " + domain.Host + ": " + domain.BaseURL)
+		}
+		custom[domain.Host] = domain
+	}
+
+	return &Domains{
+		custom:  custom,
+		options: options,
+	}, nil
+}
+
+// Check normalizes the domain of a new link and checks that owner may create
+// links on it
+func (d *Domains) Check(domain string, owner string) (string, error) {
+	domain = codec.NormalizeHost(domain)
+	if domain == "" {
+		return "", nil
+	}
+
+	custom, ok := d.custom[domain]
+	if !ok {
+		return "", ErrUnknownDomain
+	}
+	if len(custom.Owners) > 0 && !slices.Contains(custom.Owners, owner) {
+		return "", ErrDomainNotAllowed
+	}
+
+	return domain, nil
+}
+
+// ShortLink returns the public short URL of a code on a domain
+func (d *Domains) ShortLink(domain string, code string) string {
+	if custom, ok := d.custom[domain]; ok {
+		return custom.BaseURL + code
+	}
+	return d.options.BaseURL + code
+}
+
+// isValidBaseURL checks a base URL of a domain, unlike the long URLs of the
+// links it may point at a bare host like localhost
+func isValidBaseURL(baseURL string) bool {
+	u, err := url.Parse(baseURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,952 @@
+// Package shorten serves the API creating and managing the short links, it
+// is run by the url shorten service and by the all-in-one chopurl binary.
+package shorten
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/valyala/fasthttp"
+)
+
+type ServerOptions struct {
+	Port               string        `mapstructure:"port"`                  // port the server listens on
+	ShutdownTimeout    time.Duration `mapstructure:"shutdown_timeout"`      // maximum time to drain in-flight requests on shutdown
+	MaxBatchSize       int           `mapstructure:"max_batch_size"`        // maximum number of links of a /create/batch request
+	MaxRequestBodySize int           `mapstructure:"max_request_body_size"` // maximum size of a request body in bytes
+	TrustedProxies     []string      `mapstructure:"trusted_proxies"`       // IPs and CIDR ranges of the proxies whose X-Real-IP is trusted
+}
+
+const (
+	// defaultListLimit is the page size of GET /links without a limit
+	defaultListLimit = 100
+
+	// maxListLimit is the largest page size of GET /links
+	maxListLimit = 1000
+)
+
+// Dependencies are the clients and options the handler is built from
+type Dependencies struct {
+	Cache          cache.URLCache
+	CacheOptions   *cache.Options
+	IdPool         IdPool
+	LinkStore      store.LinkStore
+	Cassandra      *CassandraClient // API keys and click stats, nil without Cassandra
+	Outbox         *Outbox          // retries failed store writes, nil when a failed write fails the request
+	Authenticator  *Authenticator
+	AuthOptions    *AuthOptions
+	RateLimiter    RateLimiter     // nil when rate limiting is disabled
+	TrustedProxies *TrustedProxies // nil when no proxy is trusted
+	Domains        *Domains
+	ServerOptions  *ServerOptions
+}
+
+// NewHandler returns the handler of the shorten API
+func NewHandler(deps *Dependencies) fasthttp.RequestHandler {
+	cacheClient := deps.Cache
+	cacheOptions := deps.CacheOptions
+	idPool := deps.IdPool
+	linkStore := deps.LinkStore
+	cassandraClient := deps.Cassandra
+	outbox := deps.Outbox
+	authenticator := deps.Authenticator
+	authOptions := deps.AuthOptions
+	rateLimiter := deps.RateLimiter
+	trustedProxies := deps.TrustedProxies
+	domains := deps.Domains
+	serverOptions := deps.ServerOptions
+
+	// allow takes a token from the bucket of key, it answers 429 with a
+	// Retry-After header and returns false when the bucket is empty
+	allow := func(ctx *fasthttp.RequestCtx, key string) bool {
+		allowed, wait := rateLimiter.Allow(key)
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+			ctx.Error("Too many requests", fasthttp.StatusTooManyRequests)
+		}
+		return allowed
+	}
+
+	// Add CORS and rate limiting middleware
+	middleware := func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			// Add CORS headers
+			// ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+			// ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
+			// ctx.Response.Header.Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, X-CSRF-Token")
+			// ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+			// ctx.Response.Header.Set("Access-Control-Max-Age", "86400") // 24 hours
+
+			// Handle preflight requests
+			if string(ctx.Method()) == "OPTIONS" {
+				ctx.SetStatusCode(fasthttp.StatusNoContent)
+				return
+			}
+
+			path := string(ctx.Path())
+
+			// Rate limit per client IP before the API key is checked, so
+			// requests with missing or invalid keys are throttled too and
+			// cannot be used to guess keys or to flood the key store
+			rateLimited := rateLimiter != nil && path != "/health" && path != "/metrics"
+			if rateLimited && !allow(ctx, "ip:"+trustedProxies.ClientIP(ctx)) {
+				return
+			}
+
+			// Authenticate API clients, the owner of the key is passed on to the
+			// handlers. /health, /metrics and the /keys admin endpoints are not behind keys.
+			if authOptions.Enabled && path != "/health" && path != "/metrics" && path != "/keys" && !strings.HasPrefix(path, "/keys/") {
+				apiKey, err := authenticator.Authenticate(string(ctx.Request.Header.Peek("Authorization")))
+				if err != nil {
+					if errors.Is(err, ErrInvalidAPIKey) || errors.Is(err, ErrAPIKeyRevoked) {
+						ctx.Response.Header.Set("WWW-Authenticate", "Bearer")
+						ctx.Error(err.Error(), fasthttp.StatusUnauthorized)
+						return
+					}
+					log.Printf("Error checking API key: %v", err)
+					ctx.Error("Error checking API key", fasthttp.StatusInternalServerError)
+					return
+				}
+				ctx.SetUserValue(ownerKey, apiKey.Owner)
+				ctx.SetUserValue(keyIDKey, apiKey.KeyID)
+			}
+
+			// Rate limit per API key as well, a key is limited across all the
+			// IPs it is used from
+			if rateLimited {
+				if keyID, ok := ctx.UserValue(keyIDKey).(string); ok && !allow(ctx, "key:"+keyID) {
+					return
+				}
+			}
+
+			// Call the original handler
+			h(ctx)
+		}
+	}
+
+	// releaseAlias undoes the reservation of the alias of a link that was
+	// not created, so the alias can be used again
+	releaseAlias := func(domain string, alias string, id int64) {
+		if alias == "" {
+			return
+		}
+		if err := linkStore.ReleaseAlias(codec.DomainKey(domain, alias), id); err != nil {
+			log.Printf("Error releasing alias: %v", err)
+		}
+	}
+
+	// allocateCodes allocates an ID and its base62 code for every link of
+	// domains. Codes longer than 7 characters share their shape with aliases,
+	// they are reserved in the aliases table of their domain so an alias
+	// never shadows a generated code.
+	allocateCodes := func(now time.Time, domains []string) ([]int64, []string, error) {
+		ids, err := idPool.PopN(len(domains))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes := make([]string, len(ids))
+		for i := 0; i < len(ids); i++ {
+			code := codec.Int64ToBase62(ids[i])
+			if len(code) > codec.GeneratedCodeLength {
+				reserved, err := linkStore.ReserveAlias(codec.DomainKey(domains[i], code), ids[i], now)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !reserved {
+					log.Printf("Skipping id %d, its code %s is taken by an alias", ids[i], code)
+					if ids[i], err = idPool.Pop(); err != nil {
+						return nil, nil, err
+					}
+					i--
+					continue
+				}
+			}
+			codes[i] = code
+		}
+
+		return ids, codes, nil
+	}
+
+	// allocationError maps an ID allocation error to a response status
+	allocationError := func(err error) (string, int) {
+		log.Println("Error allocating ID:", err)
+		switch {
+		case errors.Is(err, ErrIdsUnavailable):
+			return "ID allocation is temporarily unavailable", fasthttp.StatusServiceUnavailable
+		case errors.Is(err, ErrSegmentsExhausted):
+			log.Println("The id namespace is exhausted, raise its generation in the id allocation service")
+			return "Error allocating ID", fasthttp.StatusInternalServerError
+		default:
+			return "Error allocating ID", fasthttp.StatusInternalServerError
+		}
+	}
+
+	// domainError maps a domain check error to a response status
+	domainError := func(err error) (string, int) {
+		if errors.Is(err, ErrDomainNotAllowed) {
+			return err.Error(), fasthttp.StatusForbidden
+		}
+		return "Invalid domain", fasthttp.StatusBadRequest
+	}
+
+	// simple POST /create
+	// JSON body: {"long_url": "http://example.com", "alias": "spring-sale"} -> {"short_url": "http://short.url/spring-sale"}
+	// alias is optional, a random base62 code is generated when it is omitted
+	// the link expires at "expires_at" (RFC 3339) or after "ttl_seconds", both are optional
+	// "domain" creates the link on a custom domain, its aliases are independent of other domains
+	createHandler := func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsPost() {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		var requestBody struct {
+			LongURL    string     `json:"long_url"`
+			Alias      string     `json:"alias"`
+			Domain     string     `json:"domain"`
+			ExpiresAt  *time.Time `json:"expires_at"`
+			TTLSeconds int64      `json:"ttl_seconds"`
+		}
+
+		if err := json.Unmarshal(ctx.PostBody(), &requestBody); err != nil {
+			ctx.Error("Invalid request body", fasthttp.StatusBadRequest)
+			return
+		}
+
+		if !IsValidURL(requestBody.LongURL) {
+			ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
+			return
+		}
+
+		if requestBody.Alias != "" && !codec.IsValidAlias(requestBody.Alias) {
+			ctx.Error("Invalid alias", fasthttp.StatusBadRequest)
+			return
+		}
+
+		domain, err := domains.Check(requestBody.Domain, RequestOwner(ctx))
+		if err != nil {
+			message, statusCode := domainError(err)
+			ctx.Error(message, statusCode)
+			return
+		}
+
+		// Current timestamp for creation time
+		now := time.Now()
+
+		expiresAt, err := ResolveExpiry(now, requestBody.ExpiresAt, requestBody.TTLSeconds)
+		if err != nil {
+			ctx.Error("Invalid expiration: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		// generate a unique ID for the URL and its base62 code
+		ids, codes, err := allocateCodes(now, []string{domain})
+		if err != nil {
+			message, statusCode := allocationError(err)
+			if statusCode == fasthttp.StatusServiceUnavailable {
+				ctx.Response.Header.Set("Retry-After", "1")
+			}
+			ctx.Error(message, statusCode)
+			return
+		}
+		id, shortURL := ids[0], codes[0]
+
+		log.Printf("Generated id base10=%d, base62=%s\n", id, shortURL)
+
+		// reserve the alias before exposing it, the ID stays attached to the
+		// alias so the link can still be addressed by its numeric ID
+		if requestBody.Alias != "" {
+			reserved, err := linkStore.ReserveAlias(codec.DomainKey(domain, requestBody.Alias), id, now)
+			if err != nil {
+				log.Printf("Error reserving alias: %v", err)
+				ctx.Error("Error reserving alias", fasthttp.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				ctx.Error("Alias already in use", fasthttp.StatusConflict)
+				return
+			}
+
+			shortURL = requestBody.Alias
+		}
+
+		// Create URL event
+		urlEvent := &model.URLEvent{
+			LongURL:   requestBody.LongURL,
+			Alias:     requestBody.Alias,
+			Domain:    domain,
+			Owner:     RequestOwner(ctx),
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+			ID:        id,
+		}
+
+		// the mapping in the cache must not outlive the link itself
+		cacheKey := codec.DomainKey(domain, shortURL)
+		cacheTTL := model.CacheTTL(now, expiresAt, cacheOptions.URLTTL)
+
+		// without an outbox the store is the only durable copy, the link is
+		// cached once it is saved so a failed save leaves nothing behind. The
+		// redirects read a link missing from the cache through the store.
+		if outbox == nil {
+			if err := linkStore.SaveURL(urlEvent); err != nil {
+				log.Printf("Error saving URL: %v", err)
+				releaseAlias(domain, requestBody.Alias, id)
+				ctx.Error("Error saving URL", fasthttp.StatusInternalServerError)
+				return
+			}
+			log.Printf("URL saved: id=%d", id)
+
+			if err := cacheClient.AddURL(cacheKey, requestBody.LongURL, cacheTTL); err != nil {
+				log.Printf("Error storing URL in cache: %v", err)
+			}
+		} else {
+			// store the mapping in the cache
+			if err := cacheClient.AddURL(cacheKey, requestBody.LongURL, cacheTTL); err != nil {
+				releaseAlias(domain, requestBody.Alias, id)
+				ctx.Error("Error storing URL in cache", fasthttp.StatusInternalServerError)
+				return
+			}
+
+			// Save URL to the link store
+			if err := linkStore.SaveURL(urlEvent); err != nil {
+				log.Printf("Error saving URL: %v", err)
+				// We don't return an error to the client here, as the URL is already in cache
+				// The URL is persisted later by the outbox worker
+				if err := outbox.Add(urlEvent); err != nil {
+					log.Printf("Error adding URL to outbox: %v", err)
+				}
+			} else {
+				log.Printf("URL saved: id=%d", id)
+			}
+		}
+
+		// return the short URL
+		response := struct {
+			ShortURL  string     `json:"short_url"`
+			ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		}{
+			ShortURL:  domains.ShortLink(domain, shortURL),
+			ExpiresAt: expiresAt,
+		}
+
+		ctx.SetContentType("application/json")
+		ctx.SetStatusCode(fasthttp.StatusOK)
+
+		responseJSON, err := json.Marshal(response)
+		if err != nil {
+			ctx.Error("Error encoding response", fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.Write(responseJSON)
+	}
+
+	// createBatch creates the links of a chunk of a batch. Items failing
+	// validation, alias reservation or the first write get an error result,
+	// like /create the links are saved before they are cached when there is
+	// no outbox, and cached before they are saved through the outbox
+	// otherwise.
+	createBatch := func(owner string, offset int, items []BatchItem) []BatchResult {
+		now := time.Now()
+		results := make([]BatchResult, len(items))
+
+		// validate the items, only valid items get an ID
+		var pending []int
+		expiries := make([]*time.Time, len(items))
+		itemDomains := make([]string, len(items))
+		for i, item := range items {
+			results[i].Index = offset + i
+
+			if !IsValidURL(item.LongURL) {
+				results[i].Error = "Invalid URL"
+				continue
+			}
+			if item.Alias != "" && !codec.IsValidAlias(item.Alias) {
+				results[i].Error = "Invalid alias"
+				continue
+			}
+
+			expiresAt, err := ResolveExpiry(now, item.ExpiresAt, item.TTLSeconds)
+			if err != nil {
+				results[i].Error = "Invalid expiration: " + err.Error()
+				continue
+			}
+
+			domain, err := domains.Check(item.Domain, owner)
+			if err != nil {
+				results[i].Error, _ = domainError(err)
+				continue
+			}
+
+			expiries[i] = expiresAt
+			itemDomains[i] = domain
+			pending = append(pending, i)
+		}
+
+		if len(pending) == 0 {
+			return results
+		}
+
+		pendingDomains := make([]string, len(pending))
+		for j, i := range pending {
+			pendingDomains[j] = itemDomains[i]
+		}
+
+		ids, codes, err := allocateCodes(now, pendingDomains)
+		if err != nil {
+			message, _ := allocationError(err)
+			for _, i := range pending {
+				results[i].Error = message
+			}
+			return results
+		}
+
+		// reserve the aliases, every reservation is a lightweight transaction
+		shortURLs := make([]string, len(pending))
+		ForEachConcurrent(len(pending), batchWriteConcurrency, func(j int) {
+			i := pending[j]
+			shortURLs[j] = codes[j]
+			if items[i].Alias == "" {
+				return
+			}
+
+			reserved, err := linkStore.ReserveAlias(codec.DomainKey(itemDomains[i], items[i].Alias), ids[j], now)
+			if err != nil {
+				log.Printf("Error reserving alias: %v", err)
+				results[i].Error = "Error reserving alias"
+				return
+			}
+			if !reserved {
+				results[i].Error = "Alias already in use"
+				return
+			}
+			shortURLs[j] = items[i].Alias
+		})
+
+		// the links of the items left
+		var urlEvents []*model.URLEvent
+		var creating []int
+		for j, i := range pending {
+			if results[i].Error != "" {
+				continue
+			}
+			urlEvents = append(urlEvents, &model.URLEvent{
+				ID:        ids[j],
+				LongURL:   items[i].LongURL,
+				Alias:     items[i].Alias,
+				Domain:    itemDomains[i],
+				Owner:     owner,
+				CreatedAt: now,
+				ExpiresAt: expiries[i],
+			})
+			creating = append(creating, j)
+		}
+
+		// cacheURLs stores the mappings of the given links in the cache in a
+		// single pipeline, it returns the error of every link
+		cacheURLs := func(links []int) []error {
+			entries := make([]cache.Entry, len(links))
+			for n, k := range links {
+				entries[n] = cache.Entry{
+					Key:        codec.DomainKey(urlEvents[k].Domain, shortURLs[creating[k]]),
+					Value:      urlEvents[k].LongURL,
+					Expiration: model.CacheTTL(now, urlEvents[k].ExpiresAt, cacheOptions.URLTTL),
+				}
+			}
+			return cacheClient.AddURLs(entries)
+		}
+
+		var created []int
+		if outbox == nil {
+			// like /create, the links are cached once they are saved
+			for k, err := range SaveURLs(linkStore, urlEvents) {
+				if err != nil {
+					log.Printf("Error saving URL: id=%d: %v", urlEvents[k].ID, err)
+					releaseAlias(urlEvents[k].Domain, urlEvents[k].Alias, urlEvents[k].ID)
+					results[pending[creating[k]]].Error = "Error saving URL"
+					continue
+				}
+				created = append(created, k)
+			}
+
+			for _, err := range cacheURLs(created) {
+				if err != nil {
+					log.Printf("Error storing URL in cache: %v", err)
+				}
+			}
+		} else {
+			var cached []*model.URLEvent
+			all := make([]int, len(urlEvents))
+			for k := range all {
+				all[k] = k
+			}
+			for k, err := range cacheURLs(all) {
+				if err != nil {
+					log.Printf("Error storing URL in cache: %v", err)
+					releaseAlias(urlEvents[k].Domain, urlEvents[k].Alias, urlEvents[k].ID)
+					results[pending[creating[k]]].Error = "Error storing URL in cache"
+					continue
+				}
+				cached = append(cached, urlEvents[k])
+				created = append(created, k)
+			}
+
+			var unsaved []*model.URLEvent
+			for k, err := range SaveURLs(linkStore, cached) {
+				if err != nil {
+					log.Printf("Error saving URL: id=%d: %v", cached[k].ID, err)
+					unsaved = append(unsaved, cached[k])
+				}
+			}
+			if len(unsaved) > 0 {
+				if err := outbox.Add(unsaved...); err != nil {
+					log.Printf("Error adding URLs to outbox: %v", err)
+				}
+			}
+		}
+
+		for _, k := range created {
+			j := creating[k]
+			i := pending[j]
+			results[i].ShortURL = domains.ShortLink(itemDomains[i], shortURLs[j])
+			results[i].ExpiresAt = expiries[i]
+		}
+
+		return results
+	}
+
+	// POST /create/batch
+	// JSON body: an array of /create bodies, or one body per line with
+	// Content-Type application/x-ndjson. The results keep the input order,
+	// NDJSON results are streamed one line per item as chunks complete.
+	createBatchHandler := func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsPost() {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		ndjson := strings.HasPrefix(string(ctx.Request.Header.ContentType()), "application/x-ndjson")
+		items, err := ParseBatch(ctx.PostBody(), ndjson, serverOptions.MaxBatchSize)
+		if err != nil {
+			ctx.Error("Invalid request body: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		owner := RequestOwner(ctx)
+		chunks := func(yield func([]BatchResult)) {
+			for offset := 0; offset < len(items); offset += batchChunkSize {
+				end := min(offset+batchChunkSize, len(items))
+				yield(createBatch(owner, offset, items[offset:end]))
+			}
+		}
+
+		if !ndjson {
+			results := make([]BatchResult, 0, len(items))
+			chunks(func(chunk []BatchResult) {
+				results = append(results, chunk...)
+			})
+			WriteJSON(ctx, fasthttp.StatusOK, results)
+			return
+		}
+
+		ctx.SetContentType("application/x-ndjson")
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			encoder := json.NewEncoder(w)
+			chunks(func(chunk []BatchResult) {
+				for _, result := range chunk {
+					encoder.Encode(result)
+				}
+				if err := w.Flush(); err != nil {
+					log.Printf("Error streaming batch results: %v", err)
+				}
+			})
+		})
+	}
+
+	// syncCache refreshes the cached copies of a link after it changed, a link
+	// may be cached under both its alias and its base62 code, scoped to its
+	// domain. Disabled,
+	// deleted and expired links are cached as gone so the redirect service
+	// answers 410 instead of redirecting to a stale target.
+	syncCache := func(urlEvent *model.URLEvent) error {
+		keys := []string{codec.DomainKey(urlEvent.Domain, codec.Int64ToBase62(urlEvent.ID))}
+		if urlEvent.Alias != "" {
+			keys = append(keys, codec.DomainKey(urlEvent.Domain, urlEvent.Alias))
+		}
+
+		now := time.Now()
+		expired := urlEvent.ExpiresAt != nil && !now.Before(*urlEvent.ExpiresAt)
+		for _, key := range keys {
+			var err error
+			if urlEvent.Disabled || urlEvent.Deleted || expired {
+				err = cacheClient.AddGone(key, cacheOptions.URLTTL)
+			} else {
+				err = cacheClient.AddURL(key, urlEvent.LongURL, model.CacheTTL(now, urlEvent.ExpiresAt, cacheOptions.URLTTL))
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return cacheClient.PublishInvalidation(keys...)
+	}
+
+	// linkResponse is a link returned by /links, code is its alias or its
+	// base62 code
+	type linkResponse struct {
+		Code     string `json:"code"`
+		ShortURL string `json:"short_url"`
+		*model.URLEvent
+	}
+
+	newLinkResponse := func(urlEvent *model.URLEvent) linkResponse {
+		code := codec.Int64ToBase62(urlEvent.ID)
+		if urlEvent.Alias != "" {
+			code = urlEvent.Alias
+		}
+
+		return linkResponse{
+			Code:     code,
+			ShortURL: domains.ShortLink(urlEvent.Domain, code),
+			URLEvent: urlEvent,
+		}
+	}
+
+	// loadLink resolves a code on the domain of the "domain" query argument to
+	// its link and checks that the caller owns it. It writes the error
+	// response and returns nil when the link cannot be used, links of other
+	// owners or domains are reported as not found.
+	loadLink := func(ctx *fasthttp.RequestCtx, code string) *model.URLEvent {
+		domain := codec.NormalizeHost(string(ctx.QueryArgs().Peek("domain")))
+
+		// aliases are resolved through the aliases table, anything else is a
+		// base62 code
+		var id int64
+		var err error
+		if codec.IsValidAlias(code) {
+			id, err = linkStore.GetAliasID(codec.DomainKey(domain, code))
+		} else if id, err = codec.Base62ToInt64(code); err != nil {
+			ctx.Error("Invalid code", fasthttp.StatusBadRequest)
+			return nil
+		}
+
+		var urlEvent *model.URLEvent
+		if err == nil {
+			urlEvent, err = linkStore.GetURL(id)
+		}
+		if err != nil {
+			if errors.Is(err, model.ErrURLNotFound) {
+				ctx.Error("Link not found", fasthttp.StatusNotFound)
+				return nil
+			}
+			log.Printf("Error getting link: %v", err)
+			ctx.Error("Error getting link", fasthttp.StatusInternalServerError)
+			return nil
+		}
+
+		if urlEvent.Domain != domain || authOptions.Enabled && urlEvent.Owner != RequestOwner(ctx) {
+			ctx.Error("Link not found", fasthttp.StatusNotFound)
+			return nil
+		}
+
+		if urlEvent.Deleted {
+			ctx.Error("Link has been deleted", fasthttp.StatusGone)
+			return nil
+		}
+
+		return urlEvent
+	}
+
+	// GET/PATCH/DELETE /links/{code}?domain=go.example.com, domain is omitted for the default domain
+	// PATCH JSON body: {"long_url": "http://example.com", "disabled": true}, both fields are optional
+	// DELETE retires the link for good, the redirect service answers 410 Gone
+	linksHandler := func(ctx *fasthttp.RequestCtx) {
+		code := strings.TrimPrefix(string(ctx.Path()), "/links/")
+		if code == "" || strings.Contains(code, "/") {
+			ctx.Error("Invalid URL format. Expected /links/:code", fasthttp.StatusBadRequest)
+			return
+		}
+
+		urlEvent := loadLink(ctx, code)
+		if urlEvent == nil {
+			return
+		}
+
+		switch {
+		case ctx.IsGet():
+		case ctx.IsPatch():
+			var requestBody struct {
+				LongURL  *string `json:"long_url"`
+				Disabled *bool   `json:"disabled"`
+			}
+
+			if err := json.Unmarshal(ctx.PostBody(), &requestBody); err != nil {
+				ctx.Error("Invalid request body", fasthttp.StatusBadRequest)
+				return
+			}
+
+			if requestBody.LongURL != nil {
+				if !IsValidURL(*requestBody.LongURL) {
+					ctx.Error("Invalid URL", fasthttp.StatusBadRequest)
+					return
+				}
+				urlEvent.LongURL = *requestBody.LongURL
+			}
+			if requestBody.Disabled != nil {
+				urlEvent.Disabled = *requestBody.Disabled
+			}
+
+			if err := linkStore.UpdateURL(urlEvent); err != nil {
+				log.Printf("Error updating link: %v", err)
+				ctx.Error("Error updating link", fasthttp.StatusInternalServerError)
+				return
+			}
+		case ctx.IsDelete():
+			if err := linkStore.DeleteURL(urlEvent.ID); err != nil {
+				log.Printf("Error deleting link: %v", err)
+				ctx.Error("Error deleting link", fasthttp.StatusInternalServerError)
+				return
+			}
+			urlEvent.Deleted = true
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		if !ctx.IsGet() {
+			if err := syncCache(urlEvent); err != nil {
+				log.Printf("Error refreshing cache: %v", err)
+				ctx.Error("Error refreshing cache", fasthttp.StatusInternalServerError)
+				return
+			}
+		}
+
+		if urlEvent.Deleted {
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+			return
+		}
+
+		WriteJSON(ctx, fasthttp.StatusOK, newLinkResponse(urlEvent))
+	}
+
+	// GET /links?after={code}&limit=100 lists the links of the caller in ID
+	// order, the "next" code of a page is the after argument of the next one.
+	// Deleted links are left out.
+	listLinksHandler := func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsGet() {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		args := ctx.QueryArgs()
+		var after int64
+		if code := string(args.Peek("after")); code != "" {
+			var err error
+			if after, err = codec.Base62ToInt64(code); err != nil {
+				ctx.Error("Invalid after code", fasthttp.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := args.GetUintOrZero("limit")
+		if limit <= 0 {
+			limit = defaultListLimit
+		}
+		limit = min(limit, maxListLimit)
+
+		urlEvents, err := linkStore.ListURLs(RequestOwner(ctx), after, limit)
+		if err != nil {
+			log.Printf("Error listing links: %v", err)
+			ctx.Error("Error listing links", fasthttp.StatusInternalServerError)
+			return
+		}
+
+		links := make([]linkResponse, len(urlEvents))
+		for i, urlEvent := range urlEvents {
+			links[i] = newLinkResponse(urlEvent)
+		}
+
+		// a full page may be followed by more links
+		var next string
+		if len(urlEvents) == limit {
+			next = codec.Int64ToBase62(urlEvents[len(urlEvents)-1].ID)
+		}
+
+		WriteJSON(ctx, fasthttp.StatusOK, struct {
+			Links []linkResponse `json:"links"`
+			Next  string         `json:"next,omitempty"`
+		}{
+			Links: links,
+			Next:  next,
+		})
+	}
+
+	// GET /stats/{code}?from=2025-01-01&to=2025-01-31&granularity=day&top=10
+	// returns the total clicks, the clicks per day or hour over the range and
+	// the top referrers, user agent families and countries of a short code,
+	// a code of a custom domain takes the domain query argument like /links
+	statsHandler := func(ctx *fasthttp.RequestCtx) {
+		if !ctx.IsGet() {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		code := strings.TrimPrefix(string(ctx.Path()), "/stats/")
+		if code == "" || strings.Contains(code, "/") {
+			ctx.Error("Invalid URL format. Expected /stats/:code", fasthttp.StatusBadRequest)
+			return
+		}
+
+		// the click counters are kept in Cassandra
+		if cassandraClient == nil {
+			ctx.Error("Link stats require Cassandra", fasthttp.StatusNotImplemented)
+			return
+		}
+
+		// only the owner of a link can read its stats
+		urlEvent := loadLink(ctx, code)
+		if urlEvent == nil {
+			return
+		}
+
+		args := ctx.QueryArgs()
+		statsQuery, err := ParseStatsQuery(
+			time.Now(),
+			string(args.Peek("from")),
+			string(args.Peek("to")),
+			string(args.Peek("granularity")),
+			args.GetUintOrZero("top"),
+		)
+		if err != nil {
+			ctx.Error("Invalid stats query: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		// the clicks of the alias and of the generated code of a link are
+		// counted together under its ID
+		stats, err := cassandraClient.GetLinkStats(code, codec.LinkKey(urlEvent.Domain, urlEvent.ID), statsQuery)
+		if err != nil {
+			log.Printf("Error getting stats: %v", err)
+			ctx.Error("Error getting stats", fasthttp.StatusInternalServerError)
+			return
+		}
+
+		WriteJSON(ctx, fasthttp.StatusOK, stats)
+	}
+
+	// POST /keys
+	// JSON body: {"owner": "acme"} -> {"key_id": "...", "api_key": "<key_id>.<secret>", ...}
+	// DELETE /keys/{key_id} revokes a key
+	// both require the X-Admin-Token header, the full API key is only returned once
+	keysHandler := func(ctx *fasthttp.RequestCtx) {
+		if !authenticator.IsAdmin(string(ctx.Request.Header.Peek("X-Admin-Token"))) {
+			ctx.Error("Forbidden", fasthttp.StatusForbidden)
+			return
+		}
+
+		// the API keys are kept in Cassandra
+		if cassandraClient == nil {
+			ctx.Error("API keys require Cassandra", fasthttp.StatusNotImplemented)
+			return
+		}
+
+		path := string(ctx.Path())
+		switch {
+		case path == "/keys" && ctx.IsPost():
+			var requestBody struct {
+				Owner string `json:"owner"`
+			}
+
+			if err := json.Unmarshal(ctx.PostBody(), &requestBody); err != nil || requestBody.Owner == "" {
+				ctx.Error("Invalid request body", fasthttp.StatusBadRequest)
+				return
+			}
+
+			apiKey, token, err := authenticator.CreateKey(requestBody.Owner)
+			if err != nil {
+				log.Printf("Error creating API key: %v", err)
+				ctx.Error("Error creating API key", fasthttp.StatusInternalServerError)
+				return
+			}
+
+			WriteJSON(ctx, fasthttp.StatusCreated, struct {
+				*APIKey
+				Token string `json:"api_key"`
+			}{
+				APIKey: apiKey,
+				Token:  token,
+			})
+		case strings.HasPrefix(path, "/keys/") && ctx.IsDelete():
+			if err := authenticator.RevokeKey(strings.TrimPrefix(path, "/keys/")); err != nil {
+				if errors.Is(err, ErrInvalidAPIKey) {
+					ctx.Error("API key not found", fasthttp.StatusNotFound)
+					return
+				}
+				log.Printf("Error revoking API key: %v", err)
+				ctx.Error("Error revoking API key", fasthttp.StatusInternalServerError)
+				return
+			}
+
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+		default:
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		}
+	}
+
+	// health check
+	healthHandler := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.Write([]byte("OK"))
+	}
+
+	// Prometheus metrics of the id pool and the outbox, not exposed through nginx
+	metricsHandler := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("text/plain; version=0.0.4")
+		idPool.WriteMetrics(ctx)
+		if outbox != nil {
+			outbox.WriteMetrics(ctx)
+		}
+	}
+
+	// Set up the handler
+	router := func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		switch {
+		case path == "/create":
+			createHandler(ctx)
+		case path == "/create/batch":
+			createBatchHandler(ctx)
+		case path == "/health":
+			healthHandler(ctx)
+		case path == "/metrics":
+			metricsHandler(ctx)
+		case path == "/keys" || strings.HasPrefix(path, "/keys/"):
+			keysHandler(ctx)
+		case path == "/links":
+			listLinksHandler(ctx)
+		case strings.HasPrefix(path, "/links/"):
+			linksHandler(ctx)
+		case strings.HasPrefix(path, "/stats/"):
+			statsHandler(ctx)
+		default:
+			ctx.Error("Not found", fasthttp.StatusNotFound)
+		}
+	}
+	return middleware(router)
+}
@@ -0,0 +1,165 @@
+package shorten
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/valyala/fasthttp"
+)
+
+// sequentialIdPool hands out the ids from 1
+type sequentialIdPool struct {
+	lock sync.Mutex
+	next int64
+}
+
+func (p *sequentialIdPool) Pop() (int64, error) {
+	ids, err := p.PopN(1)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (p *sequentialIdPool) PopN(n int) ([]int64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ids := make([]int64, n)
+	for i := range ids {
+		p.next++
+		ids[i] = p.next
+	}
+	return ids, nil
+}
+
+func (p *sequentialIdPool) WriteMetrics(w io.Writer) {}
+
+func post(handler fasthttp.RequestHandler, path string, body string) *fasthttp.RequestCtx {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(body)
+	handler(&ctx)
+	return &ctx
+}
+
+// TestCreateWithoutOutbox checks that without an outbox a link whose save
+// fails is never cached, so it cannot redirect without being stored, and
+// that its alias is released
+func TestCreateWithoutOutbox(t *testing.T) {
+	domains, err := NewDomains(&DomainOptions{BaseURL: "http://localhost/short/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryCache := cache.NewMemoryCache(100)
+	linkStore := &failingStore{LinkStore: store.NewMemoryStore()}
+	authOptions := AuthOptions{}
+	handler := NewHandler(&Dependencies{
+		Cache:         memoryCache,
+		CacheOptions:  &cache.Options{URLTTL: time.Hour},
+		IdPool:        &sequentialIdPool{},
+		LinkStore:     linkStore,
+		Authenticator: NewAuthenticator(&authOptions, nil),
+		AuthOptions:   &authOptions,
+		Domains:       domains,
+		ServerOptions: &ServerOptions{MaxBatchSize: 10},
+	})
+
+	cached := func(id int64) bool {
+		_, err := memoryCache.GetURL(codec.Int64ToBase62(id))
+		if err != nil && !errors.Is(err, cache.ErrCacheMiss) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+	stored := func(id int64) bool {
+		_, err := linkStore.GetURL(id)
+		if err != nil && !errors.Is(err, model.ErrURLNotFound) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// id 1 fails to save
+	ctx := post(handler, "/create", `{"long_url": "https://example.com/a"}`)
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusInternalServerError {
+		t.Errorf("status of a failed save = %d, want 500", status)
+	}
+	if cached(1) {
+		t.Error("link of a failed save is cached")
+	}
+
+	// id 2 is saved, then cached
+	ctx = post(handler, "/create", `{"long_url": "https://example.com/b"}`)
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", status, ctx.Response.Body())
+	}
+	if !stored(2) || !cached(2) {
+		t.Errorf("link 2 stored = %v, cached = %v, want both", stored(2), cached(2))
+	}
+
+	// ids 3 to 6, the odd ones fail to save
+	ctx = post(handler, "/create/batch", `[{"long_url": "https://example.com/3"}, {"long_url": "https://example.com/4"}, {"long_url": "https://example.com/5"}, {"long_url": "https://example.com/6"}]`)
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("status of the batch = %d, want 200: %s", status, ctx.Response.Body())
+	}
+	var results []BatchResult
+	if err := json.Unmarshal(ctx.Response.Body(), &results); err != nil {
+		t.Fatalf("batch response %s: %v", ctx.Response.Body(), err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("batch results = %+v, want 4", results)
+	}
+	for i, result := range results {
+		id := int64(i + 3)
+		failed := id%2 == 1
+		if (result.Error != "") != failed || (result.ShortURL == "") == !failed {
+			t.Errorf("result of id %d = %+v", id, result)
+		}
+		if cached(id) == failed || stored(id) == failed {
+			t.Errorf("link %d stored = %v, cached = %v", id, stored(id), cached(id))
+		}
+	}
+
+	// the alias of a link that failed to save is released, id 7 fails and
+	// the same alias is created with id 8
+	ctx = post(handler, "/create", `{"long_url": "https://example.com/7", "alias": "spring-sale"}`)
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusInternalServerError {
+		t.Errorf("status of a failed save = %d, want 500", status)
+	}
+	if _, err := linkStore.GetAliasID("spring-sale"); !errors.Is(err, model.ErrURLNotFound) {
+		t.Errorf("alias of a failed save still bound, error = %v", err)
+	}
+	ctx = post(handler, "/create", `{"long_url": "https://example.com/8", "alias": "spring-sale"}`)
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("status of a retried alias = %d, want 200: %s", status, ctx.Response.Body())
+	}
+	if id, err := linkStore.GetAliasID("spring-sale"); err != nil || id != 8 {
+		t.Errorf("GetAliasID() = %d, %v, want 8", id, err)
+	}
+
+	// the same in a batch, id 9 fails and id 10 is created
+	ctx = post(handler, "/create/batch", `[{"long_url": "https://example.com/9", "alias": "summer-sale"}, {"long_url": "https://example.com/10", "alias": "winter-sale"}]`)
+	if err := json.Unmarshal(ctx.Response.Body(), &results); err != nil {
+		t.Fatalf("batch response %s: %v", ctx.Response.Body(), err)
+	}
+	if len(results) != 2 || results[0].Error == "" || results[1].Error != "" {
+		t.Fatalf("batch results = %+v", results)
+	}
+	if _, err := linkStore.GetAliasID("summer-sale"); !errors.Is(err, model.ErrURLNotFound) {
+		t.Errorf("alias of a failed save still bound, error = %v", err)
+	}
+	if id, err := linkStore.GetAliasID("winter-sale"); err != nil || id != 10 {
+		t.Errorf("GetAliasID() = %d, %v, want 10", id, err)
+	}
+}
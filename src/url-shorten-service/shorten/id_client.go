@@ -0,0 +1,169 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/id-alloc-service/idallocpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrSegmentsExhausted = errors.New("all numbers have been generated")
+	ErrIdsUnavailable    = errors.New("no ids available")
+)
+
+// IdPool hands out the link IDs, it fails with ErrIdsUnavailable when no ID
+// can be handed out right now and with ErrSegmentsExhausted when the IDs of
+// the namespace ran out
+type IdPool interface {
+	Pop() (int64, error)
+	PopN(n int) ([]int64, error)
+	WriteMetrics(w io.Writer)
+}
+
+// IdClient allocates the link IDs from the id allocation service. IDs are
+// fetched in batches and buffered, like the reserved IDs of a segment the
+// buffered IDs of an instance are skipped when it dies.
+type IdClient struct {
+	conn     *grpc.ClientConn
+	client   idallocpb.IdAllocatorClient
+	lock     sync.Mutex
+	buffer   []int64      // ids fetched ahead of the requests
+	requests atomic.Int64 // AllocateBatch calls
+	failures atomic.Int64 // AllocateBatch calls failed
+	options  *IdClientOptions
+}
+
+type IdClientOptions struct {
+	Address   string        `mapstructure:"address"`   // address of the id allocation service
+	Namespace string        `mapstructure:"namespace"` // namespace of the link ids
+	Prefetch  int           `mapstructure:"prefetch"`  // ids fetched ahead of the requests
+	Timeout   time.Duration `mapstructure:"timeout"`   // timeout of an allocation request
+}
+
+func NewIdClient(options *IdClientOptions) (*IdClient, func(), error) {
+	conn, err := grpc.NewClient(options.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, errors.New("failed to create ID allocation client: " + err.Error())
+	}
+
+	idClient := &IdClient{
+		conn:    conn,
+		client:  idallocpb.NewIdAllocatorClient(conn),
+		options: options,
+	}
+
+	// test the connection, an unknown namespace is a configuration error
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+
+	stats, err := idClient.client.Stats(ctx, &idallocpb.StatsRequest{Namespace: options.Namespace})
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.New("failed to connect to ID allocation service: " + err.Error())
+	}
+
+	log.Printf("Connected to ID allocation service at %s, namespace %s, generation %d",
+		options.Address, options.Namespace, stats.Generation)
+
+	return idClient, func() {
+		if err := conn.Close(); err != nil {
+			log.Println("failed to close ID allocation client:", err)
+		}
+	}, nil
+}
+
+// Pop hands out the next id
+func (c *IdClient) Pop() (int64, error) {
+	ids, err := c.PopN(1)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// PopN hands out n ids, the ids missing from the buffer are fetched together
+// with the next prefetch ids in a single request. It fails with
+// ErrIdsUnavailable when the service cannot be reached, the caller may retry
+// later.
+func (c *IdClient) PopN(n int) ([]int64, error) {
+	if n <= 0 {
+		return nil, errors.New("number of ids must be positive")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.buffer) < n {
+		ids, err := c.allocate(n - len(c.buffer) + c.options.Prefetch)
+		if err != nil {
+			return nil, err
+		}
+		c.buffer = append(c.buffer, ids...)
+	}
+
+	ids := make([]int64, n)
+	copy(ids, c.buffer)
+	c.buffer = c.buffer[n:]
+
+	return ids, nil
+}
+
+// allocate requests count ids from the service and maps the gRPC status to
+// the allocation errors
+func (c *IdClient) allocate(count int) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.Timeout)
+	defer cancel()
+
+	c.requests.Add(1)
+	resp, err := c.client.AllocateBatch(ctx, &idallocpb.AllocateBatchRequest{
+		Namespace: c.options.Namespace,
+		Count:     int32(count),
+	})
+	if err != nil {
+		c.failures.Add(1)
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			return nil, fmt.Errorf("%w: %v", ErrSegmentsExhausted, status.Convert(err).Message())
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return nil, fmt.Errorf("%w: %v", ErrIdsUnavailable, err)
+		default:
+			return nil, fmt.Errorf("failed to allocate ids: %w", err)
+		}
+	}
+
+	return resp.Ids, nil
+}
+
+// WriteMetrics writes the metrics of the client in the Prometheus text
+// format, the allocator metrics are exposed by the id allocation service
+func (c *IdClient) WriteMetrics(w io.Writer) {
+	c.lock.Lock()
+	buffered := len(c.buffer)
+	c.lock.Unlock()
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value int64
+	}{
+		{"id_client_requests_total", "counter", "Id allocation requests.", c.requests.Load()},
+		{"id_client_failures_total", "counter", "Id allocation requests failed.", c.failures.Load()},
+		{"id_client_buffered", "gauge", "Ids fetched ahead of the requests.", int64(buffered)},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
@@ -0,0 +1,269 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/qninhdt/chopurl/src/shared/codec"
+	"github.com/qninhdt/chopurl/src/shared/model"
+	"github.com/qninhdt/chopurl/src/shared/store"
+	"github.com/redis/go-redis/v9"
+)
+
+// Outbox keeps the links that could not be saved to the link store in a Redis
+// stream until a worker saves them. Every instance runs a worker in the same
+// consumer group, entries left pending by a dead instance are claimed by
+// another one once they have been idle for claim_idle.
+type Outbox struct {
+	cacheClient   *cache.Client
+	linkStore     store.LinkStore
+	consumer      string       // name of this instance in the consumer group
+	added         atomic.Int64 // links added to the outbox
+	addFailures   atomic.Int64 // links lost because the outbox could not be written
+	saved         atomic.Int64 // links saved by the worker
+	retryFailures atomic.Int64 // failed save attempts of the worker
+	backlog       atomic.Int64 // links waiting in the outbox
+	options       *OutboxOptions
+}
+
+type OutboxOptions struct {
+	Stream        string        `mapstructure:"stream"`         // redis stream of the unsaved links
+	Group         string        `mapstructure:"group"`          // consumer group shared by all instances
+	BatchSize     int           `mapstructure:"batch_size"`     // maximum number of links retried per read
+	RetryInterval time.Duration `mapstructure:"retry_interval"` // pause between reads of the stream
+	ClaimIdle     time.Duration `mapstructure:"claim_idle"`     // idle time before a failed or orphaned link is retried
+}
+
+func NewOutbox(options *OutboxOptions, cacheClient *cache.Client, linkStore store.LinkStore) (*Outbox, func(), error) {
+	suffix, err := codec.RandomHex(4)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	outbox := &Outbox{
+		cacheClient: cacheClient,
+		linkStore:   linkStore,
+		consumer:    hostname + "/" + suffix,
+		options:     options,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheClient.Options().SetTimeout)
+	defer cancel()
+
+	if err := outbox.createGroup(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("Retrying unsaved links from the Redis stream", options.Stream)
+
+	runCtx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		outbox.run(runCtx)
+	}()
+
+	return outbox, func() {
+		stop()
+		<-done
+	}, nil
+}
+
+// Add queues links whose store write failed. When the outbox cannot be
+// written either the links only live in the cache until their TTL.
+func (o *Outbox) Add(urlEvents ...*model.URLEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.cacheClient.Options().SetTimeout)
+	defer cancel()
+
+	pipe := o.cacheClient.Redis().Pipeline()
+	for _, urlEvent := range urlEvents {
+		value, err := json.Marshal(urlEvent)
+		if err != nil {
+			return errors.New("failed to encode URL event: " + err.Error())
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: o.options.Stream, Values: map[string]interface{}{"event": value}})
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		o.addFailures.Add(int64(len(urlEvents)))
+		return errors.New("failed to add URLs to outbox: " + err.Error())
+	}
+
+	o.added.Add(int64(len(urlEvents)))
+	return nil
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		// retry the links whose save failed or whose worker died, then wait
+		// up to retry_interval for new links. A failed link is claimed again
+		// once it has been idle for claim_idle, which paces the retries.
+		claimed, err := o.claim(ctx)
+		if err == nil {
+			o.save(ctx, claimed)
+
+			var fresh []redis.XMessage
+			fresh, err = o.read(ctx)
+			o.save(ctx, fresh)
+		}
+
+		o.refreshBacklog(ctx)
+
+		if err != nil && ctx.Err() == nil {
+			log.Println("failed to read outbox:", err)
+
+			// the stream is gone when Redis lost its data
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				if err := o.createGroup(ctx); err != nil {
+					log.Println(err)
+				}
+			}
+
+			// pause while Redis is failing
+			select {
+			case <-ctx.Done():
+			case <-time.After(o.options.RetryInterval):
+			}
+		}
+	}
+}
+
+// createGroup creates the stream and its consumer group if they do not exist,
+// the group starts at the beginning of the stream so links added before it
+// existed are saved as well
+func (o *Outbox) createGroup(ctx context.Context) error {
+	err := o.cacheClient.Redis().XGroupCreateMkStream(ctx, o.options.Stream, o.options.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.New("failed to create outbox consumer group: " + err.Error())
+	}
+	return nil
+}
+
+// claim takes over the pending links idle for claim_idle, including the ones
+// this instance failed to save before
+func (o *Outbox) claim(ctx context.Context) ([]redis.XMessage, error) {
+	messages, _, err := o.cacheClient.Redis().XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   o.options.Stream,
+		Group:    o.options.Group,
+		Consumer: o.consumer,
+		MinIdle:  o.options.ClaimIdle,
+		Start:    "0-0",
+		Count:    int64(o.options.BatchSize),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// read takes the links never delivered to a worker
+func (o *Outbox) read(ctx context.Context) ([]redis.XMessage, error) {
+	streams, err := o.cacheClient.Redis().XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    o.options.Group,
+		Consumer: o.consumer,
+		Streams:  []string{o.options.Stream, ">"},
+		Count:    int64(o.options.BatchSize),
+		Block:    o.options.RetryInterval,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var messages []redis.XMessage
+	for _, stream := range streams {
+		messages = append(messages, stream.Messages...)
+	}
+	return messages, nil
+}
+
+// save writes the links to the store and removes the saved ones from the
+// stream, the failed ones stay pending and are claimed again later
+func (o *Outbox) save(ctx context.Context, messages []redis.XMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	var ids []string
+	var urlEvents []*model.URLEvent
+	for _, message := range messages {
+		var urlEvent model.URLEvent
+		value, _ := message.Values["event"].(string)
+		if err := json.Unmarshal([]byte(value), &urlEvent); err != nil {
+			// an entry that cannot be decoded would be retried forever
+			log.Printf("Dropping undecodable outbox entry %s: %v", message.ID, err)
+			o.remove(ctx, message.ID)
+			continue
+		}
+		ids = append(ids, message.ID)
+		urlEvents = append(urlEvents, &urlEvent)
+	}
+
+	var saved []string
+	for i, err := range SaveURLs(o.linkStore, urlEvents) {
+		if err != nil {
+			o.retryFailures.Add(1)
+			log.Printf("Error retrying URL save: id=%d: %v", urlEvents[i].ID, err)
+			continue
+		}
+		saved = append(saved, ids[i])
+	}
+
+	if len(saved) > 0 {
+		o.remove(ctx, saved...)
+		o.saved.Add(int64(len(saved)))
+		log.Printf("Saved %d URLs from the outbox", len(saved))
+	}
+}
+
+// remove acknowledges and deletes entries of the stream, an entry that
+// survives is saved again, which is harmless
+func (o *Outbox) remove(ctx context.Context, ids ...string) {
+	pipe := o.cacheClient.Redis().TxPipeline()
+	pipe.XAck(ctx, o.options.Stream, o.options.Group, ids...)
+	pipe.XDel(ctx, o.options.Stream, ids...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println("failed to remove saved URLs from outbox:", err)
+	}
+}
+
+func (o *Outbox) refreshBacklog(ctx context.Context) {
+	backlog, err := o.cacheClient.Redis().XLen(ctx, o.options.Stream).Result()
+	if err != nil {
+		return
+	}
+	o.backlog.Store(backlog)
+}
+
+// WriteMetrics writes the metrics of the outbox in the Prometheus text format
+func (o *Outbox) WriteMetrics(w io.Writer) {
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value int64
+	}{
+		{"outbox_added_total", "counter", "Links added to the outbox after a failed store write.", o.added.Load()},
+		{"outbox_add_failures_total", "counter", "Links lost because the outbox could not be written.", o.addFailures.Load()},
+		{"outbox_saved_total", "counter", "Links saved to the store from the outbox.", o.saved.Load()},
+		{"outbox_retry_failures_total", "counter", "Failed store writes of links in the outbox.", o.retryFailures.Load()},
+		{"outbox_backlog", "gauge", "Links waiting in the outbox.", o.backlog.Load()},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
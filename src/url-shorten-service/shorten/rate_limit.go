@@ -0,0 +1,161 @@
+package shorten
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimiter limits the request rate of a client with a token bucket
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key. When the bucket is empty it
+	// returns false and how long to wait before retrying.
+	Allow(key string) (bool, time.Duration)
+}
+
+type RateLimitOptions struct {
+	DisableRateLimit bool    `mapstructure:"disable_rate_limit"` // disable the rate limiter
+	MaxRPS           float64 `mapstructure:"max_rps"`            // sustained requests per second of a client
+	Burst            int     `mapstructure:"rate_limit_burst"`   // size of the bucket of a client
+	Shared           bool    `mapstructure:"shared_rate_limit"`  // share the buckets of all replicas through Redis
+}
+
+// LocalRateLimiter keeps the token buckets in memory, every replica enforces
+// the limit on its own
+type LocalRateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	options *RateLimitOptions
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewLocalRateLimiter(options *RateLimitOptions) (*LocalRateLimiter, func()) {
+	limiter := &LocalRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		options: options,
+	}
+
+	// drop the buckets that have refilled, they are equivalent to new ones
+	ticker := time.NewTicker(time.Minute)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				limiter.cleanup()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return limiter, func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func (l *LocalRateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.options.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+
+	// refill the bucket for the time elapsed since the last request
+	bucket.tokens = math.Min(float64(l.options.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.options.MaxRPS)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / l.options.MaxRPS * float64(time.Second))
+	return false, wait
+}
+
+func (l *LocalRateLimiter) cleanup() {
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.options.MaxRPS >= float64(l.options.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RedisRateLimiter keeps the token buckets in Redis so the limit holds across
+// all replicas. Buckets are refilled with the Redis clock, so replicas with
+// skewed clocks agree.
+type RedisRateLimiter struct {
+	cacheClient *cache.Client
+	options     *RateLimitOptions
+}
+
+// tokenBucketScript takes a token from the bucket in KEYS[1] and returns
+// {allowed, milliseconds to wait}. ARGV is the rate per second and the burst.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+func NewRedisRateLimiter(options *RateLimitOptions, cacheClient *cache.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		cacheClient: cacheClient,
+		options:     options,
+	}
+}
+
+// Allow lets the request through when Redis is unavailable, an outage of the
+// limiter must not take the service down
+func (l *RedisRateLimiter) Allow(key string) (bool, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	result, err := tokenBucketScript.Run(ctx, l.cacheClient.Redis(), []string{"rate_limit:" + key},
+		l.options.MaxRPS, l.options.Burst).Int64Slice()
+	if err != nil || len(result) != 2 {
+		log.Printf("Error checking rate limit: %v", err)
+		return true, 0
+	}
+
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond
+}
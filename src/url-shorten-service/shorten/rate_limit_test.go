@@ -0,0 +1,50 @@
+package shorten
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalRateLimiter(t *testing.T) {
+	limiter, stop := NewLocalRateLimiter(&RateLimitOptions{MaxRPS: 10, Burst: 3})
+	defer stop()
+
+	// a full bucket lets a burst through
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("ip:1"); !allowed {
+			t.Fatalf("request %d of the burst rejected", i)
+		}
+	}
+
+	allowed, wait := limiter.Allow("ip:1")
+	if allowed {
+		t.Fatal("request past the burst allowed")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait = %v, want (0, 100ms]", wait)
+	}
+
+	// buckets are independent
+	if allowed, _ := limiter.Allow("ip:2"); !allowed {
+		t.Error("other client rejected")
+	}
+
+	// the bucket refills at max_rps
+	time.Sleep(wait + 10*time.Millisecond)
+	if allowed, _ := limiter.Allow("ip:1"); !allowed {
+		t.Error("request after the refill rejected")
+	}
+}
+
+func TestLocalRateLimiterCleanup(t *testing.T) {
+	limiter, stop := NewLocalRateLimiter(&RateLimitOptions{MaxRPS: 1000, Burst: 1})
+	defer stop()
+
+	limiter.Allow("ip:1")
+	time.Sleep(5 * time.Millisecond)
+	limiter.cleanup()
+
+	if len(limiter.buckets) != 0 {
+		t.Errorf("%d refilled buckets kept", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,405 @@
+package shorten
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+// counterBatchSize is the number of counter updates sent per Cassandra batch
+const counterBatchSize = 100
+
+// ClickCounts aggregates click events in memory before they are written to
+// the Cassandra counter tables. The counters of a link are keyed by
+// codec.LinkKey, so its alias and its generated code share them.
+type ClickCounts struct {
+	total     map[string]int64        // code -> clicks
+	daily     map[clickTimeKey]int64  // code, day -> clicks
+	hourly    map[clickTimeKey]int64  // code, hour -> clicks
+	referrers map[clickValueKey]int64 // code, referrer host -> clicks
+	agents    map[clickValueKey]int64 // code, user agent family -> clicks
+	countries map[clickValueKey]int64 // code, country -> clicks
+}
+
+type clickTimeKey struct {
+	code string
+	t    time.Time
+}
+
+type clickValueKey struct {
+	code  string
+	value string
+}
+
+// LinkStats is the pre-aggregated usage of a short code
+type LinkStats struct {
+	Code          string          `json:"code"`
+	TotalClicks   int64           `json:"total_clicks"`
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	Granularity   string          `json:"granularity"`
+	Series        []ClickBucket   `json:"series"`
+	TopReferrers  []ClickCategory `json:"top_referrers"`
+	TopUserAgents []ClickCategory `json:"top_user_agents"`
+	TopCountries  []ClickCategory `json:"top_countries"`
+}
+
+// ClickBucket is the number of clicks in a day or an hour
+type ClickBucket struct {
+	Time   time.Time `json:"time"`
+	Clicks int64     `json:"clicks"`
+}
+
+// ClickCategory is the number of clicks of a referrer, user agent family or
+// country
+type ClickCategory struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// StatsQuery selects the range and granularity of the stats of a short code
+type StatsQuery struct {
+	From        time.Time
+	To          time.Time
+	Granularity string // "day" or "hour"
+	Top         int    // number of referrers, user agents and countries
+}
+
+const (
+	maxDailyRange  = 366 * 24 * time.Hour
+	maxHourlyRange = 31 * 24 * time.Hour
+	defaultTop     = 10
+	maxTop         = 100
+)
+
+func NewClickCounts() *ClickCounts {
+	c := &ClickCounts{}
+	c.Reset()
+	return c
+}
+
+// Add counts a click event under the key of its link
+func (c *ClickCounts) Add(key string, event *model.ClickEvent) {
+	ts := event.Timestamp.UTC()
+
+	c.total[key]++
+	c.daily[clickTimeKey{code: key, t: ts.Truncate(24 * time.Hour)}]++
+	c.hourly[clickTimeKey{code: key, t: ts.Truncate(time.Hour)}]++
+	c.referrers[clickValueKey{code: key, value: ReferrerHost(event.Referrer)}]++
+	c.agents[clickValueKey{code: key, value: UserAgentFamily(event.UserAgent)}]++
+	c.countries[clickValueKey{code: key, value: CountryCode(event.Country)}]++
+}
+
+// Empty reports whether no counter is left to write
+func (c *ClickCounts) Empty() bool {
+	return len(c.total) == 0 && len(c.daily) == 0 && len(c.hourly) == 0 &&
+		len(c.referrers) == 0 && len(c.agents) == 0 && len(c.countries) == 0
+}
+
+// Reset clears all counters
+func (c *ClickCounts) Reset() {
+	c.total = make(map[string]int64)
+	c.daily = make(map[clickTimeKey]int64)
+	c.hourly = make(map[clickTimeKey]int64)
+	c.referrers = make(map[clickValueKey]int64)
+	c.agents = make(map[clickValueKey]int64)
+	c.countries = make(map[clickValueKey]int64)
+}
+
+// ReferrerHost reduces a referrer to its host to keep the number of counters
+// of a code bounded
+func ReferrerHost(referrer string) string {
+	if referrer == "" {
+		return "direct"
+	}
+
+	u, err := url.Parse(referrer)
+	if err != nil || u.Hostname() == "" {
+		return "unknown"
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// UserAgentFamily classifies a user agent into a browser or client family.
+// The order matters, most browsers also claim to be Mozilla, Safari or Chrome.
+func UserAgentFamily(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "crawler"), strings.Contains(ua, "spider"):
+		return "Bot"
+	case strings.Contains(ua, "edg/"):
+		return "Edge"
+	case strings.Contains(ua, "opr/"), strings.Contains(ua, "opera"):
+		return "Opera"
+	case strings.Contains(ua, "firefox/"):
+		return "Firefox"
+	case strings.Contains(ua, "chrome/"), strings.Contains(ua, "crios/"):
+		return "Chrome"
+	case strings.Contains(ua, "safari/"):
+		return "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		return "curl"
+	default:
+		return "Other"
+	}
+}
+
+// CountryCode normalizes an ISO 3166-1 alpha-2 country code
+func CountryCode(country string) string {
+	if len(country) != 2 {
+		return "unknown"
+	}
+	return strings.ToUpper(country)
+}
+
+// ParseStatsQuery parses the from, to, granularity and top query arguments.
+// from and to accept RFC 3339 timestamps or YYYY-MM-DD dates and default to
+// the last 30 days.
+func ParseStatsQuery(now time.Time, from string, to string, granularity string, top int) (*StatsQuery, error) {
+	query := &StatsQuery{
+		To:          now.UTC(),
+		Granularity: granularity,
+		Top:         top,
+	}
+
+	if query.Granularity == "" {
+		query.Granularity = "day"
+	}
+	if query.Granularity != "day" && query.Granularity != "hour" {
+		return nil, errors.New("granularity must be day or hour")
+	}
+
+	if query.Top == 0 {
+		query.Top = defaultTop
+	}
+	if query.Top < 0 || query.Top > maxTop {
+		return nil, errors.New("top must be between 1 and 100")
+	}
+
+	if to != "" {
+		t, isDate, err := parseStatsTime(to)
+		if err != nil {
+			return nil, errors.New("invalid to: " + err.Error())
+		}
+		// a date includes the whole day
+		if isDate {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		query.To = t
+	}
+
+	query.From = query.To.Add(-30 * 24 * time.Hour)
+	if from != "" {
+		t, _, err := parseStatsTime(from)
+		if err != nil {
+			return nil, errors.New("invalid from: " + err.Error())
+		}
+		query.From = t
+	}
+
+	maxRange := maxDailyRange
+	if query.Granularity == "hour" {
+		maxRange = maxHourlyRange
+	}
+
+	if query.To.Before(query.From) {
+		return nil, errors.New("from must be before to")
+	}
+	if query.To.Sub(query.From) > maxRange {
+		return nil, errors.New("range is too large for the granularity")
+	}
+
+	return query, nil
+}
+
+// parseStatsTime parses a YYYY-MM-DD date or an RFC 3339 timestamp, it
+// reports whether s was a date
+func parseStatsTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t.UTC(), false, nil
+}
+
+// counterUpdate is the increment of a Cassandra counter
+type counterUpdate struct {
+	query string
+	args  []interface{}
+}
+
+// apply sends the counters through execute in batches of batchSize. The
+// counters of a batch are removed once it is applied, so after an error the
+// counts only hold the counters left to write and a retry never applies a
+// batch twice.
+func (c *ClickCounts) apply(batchSize int, execute func(updates []counterUpdate) error) error {
+	var updates []counterUpdate
+	var removes []func()
+
+	send := func() error {
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := execute(updates); err != nil {
+			return err
+		}
+		for _, remove := range removes {
+			remove()
+		}
+		updates, removes = updates[:0], removes[:0]
+		return nil
+	}
+
+	add := func(update counterUpdate, remove func()) error {
+		updates = append(updates, update)
+		removes = append(removes, remove)
+		if len(updates) >= batchSize {
+			return send()
+		}
+		return nil
+	}
+
+	for code, clicks := range c.total {
+		update := counterUpdate{"UPDATE link_clicks SET clicks = clicks + ? WHERE code = ?", []interface{}{clicks, code}}
+		if err := add(update, func() { delete(c.total, code) }); err != nil {
+			return err
+		}
+	}
+
+	timeTables := []struct {
+		query  string
+		counts map[clickTimeKey]int64
+	}{
+		{"UPDATE link_clicks_by_day SET clicks = clicks + ? WHERE code = ? AND day = ?", c.daily},
+		{"UPDATE link_clicks_by_hour SET clicks = clicks + ? WHERE code = ? AND hour = ?", c.hourly},
+	}
+	for _, table := range timeTables {
+		for key, clicks := range table.counts {
+			update := counterUpdate{table.query, []interface{}{clicks, key.code, key.t}}
+			if err := add(update, func() { delete(table.counts, key) }); err != nil {
+				return err
+			}
+		}
+	}
+
+	valueTables := []struct {
+		query  string
+		counts map[clickValueKey]int64
+	}{
+		{"UPDATE link_referrers SET clicks = clicks + ? WHERE code = ? AND referrer = ?", c.referrers},
+		{"UPDATE link_user_agents SET clicks = clicks + ? WHERE code = ? AND family = ?", c.agents},
+		{"UPDATE link_countries SET clicks = clicks + ? WHERE code = ? AND country = ?", c.countries},
+	}
+	for _, table := range valueTables {
+		for key, clicks := range table.counts {
+			update := counterUpdate{table.query, []interface{}{clicks, key.code, key.value}}
+			if err := add(update, func() { delete(table.counts, key) }); err != nil {
+				return err
+			}
+		}
+	}
+
+	return send()
+}
+
+// AddClicks increments the click counters of the aggregated codes. The
+// counters are removed from counts as their batch is applied, so a retry
+// with the same counts after an error only writes the rest.
+func (c *CassandraClient) AddClicks(counts *ClickCounts) error {
+	return counts.apply(counterBatchSize, func(updates []counterUpdate) error {
+		batch := c.Session().NewBatch(gocql.CounterBatch)
+		for _, update := range updates {
+			batch.Query(update.query, update.args...)
+		}
+		if err := c.Session().ExecuteBatch(batch); err != nil {
+			return errors.New("failed to update click counters in Cassandra: " + err.Error())
+		}
+		return nil
+	})
+}
+
+// GetLinkStats retrieves the click counters of a link, code is returned as
+// the code of the stats and key is the codec.LinkKey of the link
+func (c *CassandraClient) GetLinkStats(code string, key string, statsQuery *StatsQuery) (*LinkStats, error) {
+	stats := &LinkStats{
+		Code:        code,
+		From:        statsQuery.From,
+		To:          statsQuery.To,
+		Granularity: statsQuery.Granularity,
+		Series:      []ClickBucket{},
+	}
+
+	query := "SELECT clicks FROM link_clicks WHERE code = ?"
+	if err := c.Session().Query(query, key).Scan(&stats.TotalClicks); err != nil && err != gocql.ErrNotFound {
+		return nil, errors.New("failed to get click counters from Cassandra: " + err.Error())
+	}
+
+	// the series is read in ascending order from the descending clustering
+	if statsQuery.Granularity == "hour" {
+		query = "SELECT hour, clicks FROM link_clicks_by_hour WHERE code = ? AND hour >= ? AND hour <= ? ORDER BY hour ASC"
+	} else {
+		query = "SELECT day, clicks FROM link_clicks_by_day WHERE code = ? AND day >= ? AND day <= ? ORDER BY day ASC"
+	}
+
+	var bucket ClickBucket
+	iter := c.Session().Query(query, key, statsQuery.From, statsQuery.To).Iter()
+	for iter.Scan(&bucket.Time, &bucket.Clicks) {
+		stats.Series = append(stats.Series, bucket)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.New("failed to get click series from Cassandra: " + err.Error())
+	}
+
+	var err error
+	if stats.TopReferrers, err = c.topClicks("SELECT referrer, clicks FROM link_referrers WHERE code = ?", key, statsQuery.Top); err != nil {
+		return nil, err
+	}
+	if stats.TopUserAgents, err = c.topClicks("SELECT family, clicks FROM link_user_agents WHERE code = ?", key, statsQuery.Top); err != nil {
+		return nil, err
+	}
+	if stats.TopCountries, err = c.topClicks("SELECT country, clicks FROM link_countries WHERE code = ?", key, statsQuery.Top); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// topClicks reads the counters of a code partition and keeps the top n.
+// Counters cannot be ordered by Cassandra, but a partition is bounded by
+// the number of referrer hosts, families or countries.
+func (c *CassandraClient) topClicks(query string, code string, n int) ([]ClickCategory, error) {
+	categories := []ClickCategory{}
+
+	var category ClickCategory
+	iter := c.Session().Query(query, code).Iter()
+	for iter.Scan(&category.Value, &category.Clicks) {
+		categories = append(categories, category)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.New("failed to get click counters from Cassandra: " + err.Error())
+	}
+
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Clicks != categories[j].Clicks {
+			return categories[i].Clicks > categories[j].Clicks
+		}
+		return categories[i].Value < categories[j].Value
+	})
+
+	if len(categories) > n {
+		categories = categories[:n]
+	}
+	return categories, nil
+}
@@ -0,0 +1,176 @@
+package shorten
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qninhdt/chopurl/src/shared/model"
+)
+
+func TestParseStatsQuery(t *testing.T) {
+	now := time.Date(2026, 3, 15, 12, 30, 0, 0, time.UTC)
+
+	query, err := ParseStatsQuery(now, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Granularity != "day" || query.Top != defaultTop || !query.To.Equal(now) || !query.From.Equal(now.Add(-30*24*time.Hour)) {
+		t.Errorf("defaults = %+v", query)
+	}
+
+	// a date includes the whole day
+	query, err = ParseStatsQuery(now, "2026-01-01", "2026-01-31", "hour", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 1, 31, 23, 59, 59, 0, time.UTC); !query.To.Equal(want) {
+		t.Errorf("To = %v, want %v", query.To, want)
+	}
+	if want := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC); !query.From.Equal(want) {
+		t.Errorf("From = %v, want %v", query.From, want)
+	}
+
+	query, err = ParseStatsQuery(now, "2026-03-01T10:00:00+02:00", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC); !query.From.Equal(want) || query.From.Location() != time.UTC {
+		t.Errorf("From = %v, want %v", query.From, want)
+	}
+
+	invalid := []struct {
+		name                  string
+		from, to, granularity string
+		top                   int
+	}{
+		{name: "granularity", granularity: "week"},
+		{name: "top too large", top: maxTop + 1},
+		{name: "negative top", top: -1},
+		{name: "invalid from", from: "yesterday"},
+		{name: "invalid to", to: "2026-13-01"},
+		{name: "from after to", from: "2026-02-01", to: "2026-01-01"},
+		{name: "daily range too large", from: "2024-01-01", to: "2026-01-01"},
+		{name: "hourly range too large", from: "2026-01-01", to: "2026-03-01", granularity: "hour"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if query, err := ParseStatsQuery(now, tt.from, tt.to, tt.granularity, tt.top); err == nil {
+				t.Errorf("ParseStatsQuery() = %+v, want an error", query)
+			}
+		})
+	}
+}
+
+func TestUserAgentFamily(t *testing.T) {
+	tests := map[string]string{
+		"": "unknown",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":               "Chrome",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0": "Edge",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 OPR/105.0.0.0": "Opera",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                        "Firefox",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0 Mobile/15E148":     "Chrome",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15":            "Safari",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                      "Bot",
+		"curl/8.4.0": "curl",
+		"Wget/1.21":  "Other",
+	}
+
+	for userAgent, want := range tests {
+		if got := UserAgentFamily(userAgent); got != want {
+			t.Errorf("UserAgentFamily(%q) = %q, want %q", userAgent, got, want)
+		}
+	}
+}
+
+func TestReferrerHostAndCountryCode(t *testing.T) {
+	for referrer, want := range map[string]string{
+		"":                               "direct",
+		"https://News.Example.com/a?b=c": "news.example.com",
+		"not a url":                      "unknown",
+	} {
+		if got := ReferrerHost(referrer); got != want {
+			t.Errorf("ReferrerHost(%q) = %q, want %q", referrer, got, want)
+		}
+	}
+
+	for country, want := range map[string]string{"vn": "VN", "US": "US", "": "unknown", "USA": "unknown"} {
+		if got := CountryCode(country); got != want {
+			t.Errorf("CountryCode(%q) = %q, want %q", country, got, want)
+		}
+	}
+}
+
+func TestClickCountsAdd(t *testing.T) {
+	counts := NewClickCounts()
+	ts := time.Date(2026, 3, 15, 12, 30, 0, 0, time.UTC)
+
+	// the alias and the generated code of a link are counted under one key
+	counts.Add("0000001", &model.ClickEvent{Code: "my-link", Timestamp: ts, Country: "vn"})
+	counts.Add("0000001", &model.ClickEvent{Code: "0000001", Timestamp: ts.Add(time.Hour)})
+
+	if counts.total["0000001"] != 2 || len(counts.total) != 1 {
+		t.Errorf("total = %v", counts.total)
+	}
+	if got := counts.daily[clickTimeKey{code: "0000001", t: time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)}]; got != 2 {
+		t.Errorf("daily clicks = %d, want 2", got)
+	}
+	if len(counts.hourly) != 2 {
+		t.Errorf("hourly = %v", counts.hourly)
+	}
+	if got := counts.countries[clickValueKey{code: "0000001", value: "VN"}]; got != 1 {
+		t.Errorf("VN clicks = %d, want 1", got)
+	}
+
+	counts.Reset()
+	if !counts.Empty() {
+		t.Error("counts not empty after Reset")
+	}
+}
+
+func TestClickCountsApplyResumes(t *testing.T) {
+	counts := NewClickCounts()
+	ts := time.Date(2026, 3, 15, 12, 30, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		counts.Add(strconv.Itoa(i), &model.ClickEvent{Code: strconv.Itoa(i), Timestamp: ts, Country: "vn"})
+	}
+
+	// every counter is incremented once, the third batch fails once
+	applied := make(map[string]int64)
+	batches := 0
+	execute := func(updates []counterUpdate) error {
+		batches++
+		if batches == 3 {
+			return errors.New("write timeout")
+		}
+		for _, update := range updates {
+			applied[fmt.Sprint(update.query, update.args[1:])] += update.args[0].(int64)
+		}
+		return nil
+	}
+
+	if err := counts.apply(25, execute); err == nil {
+		t.Fatal("apply() succeeded, want the error of the third batch")
+	}
+	if counts.Empty() {
+		t.Fatal("counts empty after a failed batch")
+	}
+	if err := counts.apply(25, execute); err != nil {
+		t.Fatal(err)
+	}
+	if !counts.Empty() {
+		t.Error("counts not empty after apply")
+	}
+
+	// 6 counters per code
+	if len(applied) != 240 {
+		t.Errorf("%d counters applied, want 240", len(applied))
+	}
+	for counter, clicks := range applied {
+		if clicks != 1 {
+			t.Errorf("%s incremented by %d, want 1", counter, clicks)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package shorten
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func IsValidURL(url string) bool {
+	// Check if the URL starts with http:// or https://
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return false
+	}
+	// Check if the URL contains a domain name
+	if strings.Count(url, ".") < 1 {
+		return false
+	}
+	// Check if the URL contains a path
+	if strings.Count(url, "/") < 2 {
+		return false
+	}
+	return true
+}
+
+// maxTTLSeconds is the largest ttl_seconds that fits in a time.Duration
+const maxTTLSeconds = math.MaxInt64 / int64(time.Second)
+
+// ResolveExpiry computes the absolute expiry of a link from either an absolute
+// timestamp or a relative TTL in seconds. It returns nil when the link never
+// expires.
+func ResolveExpiry(now time.Time, expiresAt *time.Time, ttlSeconds int64) (*time.Time, error) {
+	if expiresAt != nil && ttlSeconds != 0 {
+		return nil, errors.New("expires_at and ttl_seconds are mutually exclusive")
+	}
+
+	if ttlSeconds < 0 {
+		return nil, errors.New("ttl_seconds must be positive")
+	}
+
+	if ttlSeconds > maxTTLSeconds {
+		return nil, errors.New("ttl_seconds is too large")
+	}
+
+	if ttlSeconds > 0 {
+		t := now.Add(time.Duration(ttlSeconds) * time.Second)
+		expiresAt = &t
+	}
+
+	if expiresAt != nil && !expiresAt.After(now) {
+		return nil, errors.New("expires_at must be in the future")
+	}
+
+	return expiresAt, nil
+}
+
+// TrustedProxies are the reverse proxies, like nginx, whose X-Real-IP header
+// is the IP of the client. Any other peer could set the header to dodge the
+// rate limit of its own IP.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies parses the IPs and CIDR ranges of the trusted proxies
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, errors.New("invalid trusted proxy: " + proxy)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy: " + proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return &TrustedProxies{prefixes: prefixes}, nil
+}
+
+// ClientIP returns the IP of the client, the X-Real-IP header when the peer
+// is a trusted proxy and the peer otherwise. A nil TrustedProxies trusts no
+// proxy.
+func (p *TrustedProxies) ClientIP(ctx *fasthttp.RequestCtx) string {
+	remoteIP := ctx.RemoteIP()
+	if p != nil && p.contains(remoteIP) {
+		if ip := ctx.Request.Header.Peek("X-Real-IP"); len(ip) > 0 {
+			return string(ip)
+		}
+	}
+	return remoteIP.String()
+}
+
+func (p *TrustedProxies) contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForEachConcurrent calls fn for every index in [0, n) from at most
+// concurrency goroutines and waits for all of them
+func ForEachConcurrent(n int, concurrency int, fn func(i int)) {
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(n, concurrency); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// WriteJSON encodes v as the JSON response body
+func WriteJSON(ctx *fasthttp.RequestCtx, statusCode int, v interface{}) {
+	responseJSON, err := json.Marshal(v)
+	if err != nil {
+		ctx.Error("Error encoding response", fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(statusCode)
+	ctx.Write(responseJSON)
+}
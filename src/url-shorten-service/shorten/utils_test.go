@@ -0,0 +1,97 @@
+package shorten
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestResolveExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Second)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		expiresAt  *time.Time
+		ttlSeconds int64
+		want       *time.Time
+		wantErr    bool
+	}{
+		{name: "never expires"},
+		{name: "expires_at", expiresAt: &future, want: &future},
+		{name: "expires_at in the past", expiresAt: &past, wantErr: true},
+		{name: "expires_at now", expiresAt: &now, wantErr: true},
+		{name: "ttl_seconds", ttlSeconds: 3600, want: &future},
+		{name: "negative ttl_seconds", ttlSeconds: -1, wantErr: true},
+		{name: "both", expiresAt: &future, ttlSeconds: 3600, wantErr: true},
+		{name: "largest ttl_seconds", ttlSeconds: maxTTLSeconds, want: ptr(now.Add(time.Duration(maxTTLSeconds) * time.Second))},
+		{name: "ttl_seconds overflow", ttlSeconds: 10000000000, wantErr: true},
+		{name: "ttl_seconds past the duration range", ttlSeconds: maxTTLSeconds + 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveExpiry(now, tt.expiresAt, tt.ttlSeconds)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ResolveExpiry() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveExpiry() error = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(*tt.want)) {
+				t.Fatalf("ResolveExpiry() = %v, want %v", got, tt.want)
+			}
+			if got != nil && !got.After(now) {
+				t.Fatalf("ResolveExpiry() = %v, not after %v", got, now)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	trustedProxies, err := NewTrustedProxies([]string{"172.16.0.0/12", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		proxies  *TrustedProxies
+		remoteIP string
+		realIP   string
+		want     string
+	}{
+		{name: "trusted range", proxies: trustedProxies, remoteIP: "172.18.0.5", realIP: "203.0.113.7", want: "203.0.113.7"},
+		{name: "trusted address", proxies: trustedProxies, remoteIP: "10.0.0.1", realIP: "203.0.113.7", want: "203.0.113.7"},
+		{name: "trusted without header", proxies: trustedProxies, remoteIP: "172.18.0.5", want: "172.18.0.5"},
+		{name: "untrusted peer", proxies: trustedProxies, remoteIP: "10.0.0.2", realIP: "203.0.113.7", want: "10.0.0.2"},
+		{name: "no trusted proxies", remoteIP: "172.18.0.5", realIP: "203.0.113.7", want: "172.18.0.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(tt.remoteIP)}, nil)
+			if tt.realIP != "" {
+				ctx.Request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := tt.proxies.ClientIP(&ctx); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewTrustedProxies([]string{"nginx"}); err == nil {
+		t.Error("NewTrustedProxies() of a host name succeeded")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}